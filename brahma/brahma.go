@@ -4,20 +4,41 @@
 
 // brahma performs annotation of GFF intervals produced by PALS/PILER, taking
 // annotation information from a GFF file generated from RepeatMasker output.
+//
+// By default the annotation is written as a single quoted GFF2 Annot attribute
+// holding a map of the repeats over the feature followed by the repeat names
+// and their coverage. With -gff3, features are written in GFF3 format with the
+// map in the Annot attribute, and the name of the ith repeat in RepeatName_i.
+// When the consensus position of the repeat is known, the percentage of the
+// masked and of the complete element covered by the feature are given in
+// MaskedCoverage_i and ElementCoverage_i.
+//
+// With -json, the matches for each target feature are also written to the
+// named file as one JSON object per line, including features with no matches.
+// Feature coordinates in the JSON output are 1-based, as in GFF.
+//
+// With -summary, no features are written. Instead, histograms of the number
+// of matches per target feature and of the lengths of the retained overlaps
+// are written to the output.
 package main
 
 import (
 	"bufio"
 	"bytes"
 	"container/heap"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/bits"
 	"os"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 
 	"github.com/biogo/biogo/feat"
@@ -28,31 +49,135 @@ import (
 )
 
 const (
-	maxAnnotations   = 8
 	annotationLength = 256
-	mapLen           = 20
-	maxMargin        = 1. / mapLen
+
+	// maxLetters is the maximum number of annotations that
+	// can be distinctly represented in an annotation map.
+	maxLetters = 'z' - 'a' + 1
 )
 
 var (
+	// minOverlap and minBases specify the minimum
+	// overlap between a target feature and a repeat
+	// as a fraction of the target length and in
+	// bases. The larger of the two is used.
 	minOverlap float64
+	minBases   int
+
+	// withClass and covByClass specify whether the
+	// repeat class is included in annotation names
+	// and in the coverage report grouping.
+	withClass  bool
+	covByClass bool
+
+	// lenient specifies that repeat tags with
+	// missing consensus fields are accepted.
+	lenient bool
+
+	// minElement is the minimum percentage of the
+	// complete repeat element that a match must cover.
+	minElement float64
+
+	// strict and fixOrient specify the handling
+	// of records with inverted consensus positions.
+	strict    bool
+	fixOrient bool
+
+	// inverted is the set of IDs of inverted records
+	// seen. It is protected by the coverage lock.
+	inverted = make(map[uintptr]bool)
 )
 
 type trees map[string]*interval.IntTree
 
+// read inserts the RepeatMasker features in the named GFF file into
+// the trees, keyed by sequence name. Record IDs are allocated starting
+// from id and the next unused ID is returned.
+func (ts trees) read(name string, id uintptr) uintptr {
+	sf, err := os.Open(name)
+	if err != nil {
+		log.Fatalf("could not open %q: %v", name, err)
+	}
+	defer sf.Close()
+	fmt.Fprintf(os.Stderr, "reading annotation features from %q.\n", name)
+
+	// Note whether earlier files have provided repeats so that
+	// disagreement about the repeat tag can be reported clearly.
+	first := len(ts) == 0
+
+	source := gff.NewReader(sf)
+	for n := 1; ; n++ {
+		f, err := source.Read()
+		if err != nil {
+			if err != io.EOF {
+				log.Fatalf("failed to read source feature from %q: %v", name, err)
+			}
+			break
+		}
+
+		gf := f.(*gff.Feature)
+		repData := &record{
+			id: id,
+			genomic: repeat{
+				left:  gf.FeatStart,
+				right: gf.FeatEnd,
+				loc:   contig(gf.SeqName),
+			},
+		}
+		id++
+
+		ra := gf.FeatAttributes.Get("Repeat")
+		if ra == "" {
+			if !first {
+				log.Fatalf("missing repeat tag in %q: file disagrees with preceding source annotation.", name)
+			}
+			log.Fatalf("missing repeat tag in %q: file probably not an RM gff.", name)
+		}
+		err = repData.parse(ra)
+		if err != nil {
+			log.Fatalf("failed to parse repeat tag of feature %d in %q: %v\n", n, name, err)
+		}
+
+		if t, ok := ts[gf.SeqName]; ok {
+			err = t.Insert(repData, true)
+		} else {
+			t = &interval.IntTree{}
+			err = t.Insert(repData, true)
+			ts[gf.SeqName] = t
+		}
+		if err != nil {
+			log.Fatalf("insertion error: %v with repeat: %v\n", err, gf)
+		}
+	}
+	return id
+}
+
 func main() {
 	var (
 		target *gff.Reader
-		source *gff.Reader
-		out    *gff.Writer
+		out    featureWriter
 		err    error
 	)
 
 	targetName := flag.String("target", "", "Filename for input to be annotated. Defaults to stdin.")
-	sourceName := flag.String("source", "", "Filename for source annotation.")
+	sourceName := flag.String("source", "", "Comma-separated list of filenames for source annotation.")
 	outName := flag.String("out", "", "Filename for output. Defaults to stdout.")
-	flag.Float64Var(&minOverlap, "overlap", 0.05, "Overlap between features.")
+	flag.Float64Var(&minOverlap, "overlap", 0.05, "Overlap between features as a fraction of the target feature length.")
+	flag.IntVar(&minBases, "minbp", 0, "Minimum overlap between features in bases. The larger of this and -overlap is used.")
+	flag.Float64Var(&minElement, "minelem", 0, "Minimum percentage of the complete repeat element covered by a match. Matches to repeats without a known consensus position are retained.")
+	flag.BoolVar(&withClass, "withclass", false, "Annotate repeats as name#class.")
+	flag.BoolVar(&covByClass, "covclass", false, "Group coverage reports by repeat name and class.")
+	flag.BoolVar(&lenient, "lenient", false, "Treat missing consensus position fields in source repeat tags as unknown.")
+	flag.BoolVar(&strict, "strict", false, "Log records with inverted consensus positions during coverage calculation.")
+	flag.BoolVar(&fixOrient, "fixorient", false, "Swap inverted consensus positions during coverage calculation rather than discarding them.")
+	maxAnnotations := flag.Int("maxannot", 8, "Maximum number of annotations per feature, retaining those with greatest overlap.")
+	mapLen := flag.Int("maplen", 20, "Length of the annotation map.")
+	gff3 := flag.Bool("gff3", false, "Write GFF3 with structured annotation attributes.")
+	jsonName := flag.String("json", "", "Filename for per-feature JSON match output.")
 	covRep := flag.String("covrep", "", "Filename for repeat type coverage report.")
+	covBed := flag.String("covbed", "", "Filename for repeat type coverage bedGraph.")
+	summarise := flag.Bool("summary", false, "Write a summary of match counts and overlaps instead of annotated features.")
+	threads := flag.Int("threads", 1, "Number of annotation threads.")
 	help := flag.Bool("help", false, "Print this usage message.")
 
 	flag.Parse()
@@ -61,6 +186,24 @@ func main() {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *maxAnnotations < 1 {
+		log.Fatalf("invalid maximum number of annotations: %d", *maxAnnotations)
+	}
+	if minBases < 0 {
+		log.Fatalf("invalid minimum overlap: %d", minBases)
+	}
+	if *mapLen < 1 {
+		log.Fatalf("invalid annotation map length: %d", *mapLen)
+	}
+	if *threads < 1 {
+		log.Fatalf("invalid number of threads: %d", *threads)
+	}
+	if *threads > runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(*threads)
+	}
+	if *maxAnnotations > maxLetters {
+		fmt.Fprintf(os.Stderr, "more than %d annotations: map will be ambiguous and names will be numbered.\n", maxLetters)
+	}
 
 	if *targetName == "" {
 		fmt.Fprintln(os.Stderr, "reading PALS features from stdin.")
@@ -73,185 +216,405 @@ func main() {
 		target = gff.NewReader(tf)
 	}
 
-	sf, err := os.Open(*sourceName)
-	if err != nil {
-		log.Fatalf("could not open %q: %v", *sourceName, err)
-	}
-	fmt.Fprintf(os.Stderr, "reading annotation features from %q.\n", *sourceName)
-	defer sf.Close()
-	source = gff.NewReader(sf)
-
+	var w io.Writer
 	if *outName == "" {
 		fmt.Fprintln(os.Stderr, "writing annotation to stdout.")
-		out = gff.NewWriter(os.Stdout, 60, false)
+		w = os.Stdout
 	} else if of, err := os.Create(*outName); err != nil {
-		log.Fatalf("could not create %q: %v", err)
+		log.Fatalf("could not create %q: %v", *outName, err)
 	} else {
 		defer of.Close()
 		buf := bufio.NewWriter(of)
 		defer buf.Flush()
-		out = gff.NewWriter(buf, 60, true)
+		w = buf
 		fmt.Fprintf(os.Stderr, "writing annotation to %q.\n", *outName)
 	}
-	out.Precision = 2
-
-	ts := make(trees)
-
-	var id uintptr
-	for {
-		f, err := source.Read()
+	var sum *summary
+	if *summarise {
+		sum = newSummary(*maxAnnotations)
+	} else if *gff3 {
+		out, err = newGFF3Writer(w, 2)
 		if err != nil {
-			if err != io.EOF {
-				log.Fatalf("failed to read source feature: %v", err)
-			}
-			break
+			log.Fatalf("failed to write GFF3 header: %v", err)
 		}
+	} else {
+		gw := gff.NewWriter(w, 60, *outName != "")
+		gw.Precision = 2
+		out = gw
+	}
 
-		gf := f.(*gff.Feature)
-		repData := &record{
-			id: id,
-			genomic: repeat{
-				left:  gf.FeatStart,
-				right: gf.FeatEnd,
-				loc:   contig(gf.SeqName),
-			},
-		}
-		id++
-
-		ra := gf.FeatAttributes.Get("Repeat")
-		if ra == "" {
-			log.Fatal("missing repeat tag: file probably not an RM gff.")
-		}
-		err = repData.parse(ra)
+	var js *json.Encoder
+	if *jsonName != "" {
+		jf, err := os.Create(*jsonName)
 		if err != nil {
-			log.Fatalf("failed to parse repeat tag: %v\n", err)
+			log.Fatalf("could not create %q: %v", *jsonName, err)
 		}
+		defer jf.Close()
+		buf := bufio.NewWriter(jf)
+		defer buf.Flush()
+		js = json.NewEncoder(buf)
+		fmt.Fprintf(os.Stderr, "writing JSON matches to %q.\n", *jsonName)
+	}
 
-		if t, ok := ts[gf.SeqName]; ok {
-			err = t.Insert(repData, true)
-		} else {
-			t = &interval.IntTree{}
-			err = t.Insert(repData, true)
-			ts[gf.SeqName] = t
-		}
-		if err != nil {
-			log.Fatalf("insertion error: %v with repeat: %v\n", err, gf)
-		}
+	ts := make(trees)
+	var id uintptr
+	for _, name := range strings.Split(*sourceName, ",") {
+		id = ts.read(name, id)
 	}
 	for _, t := range ts {
 		t.AdjustRanges()
 	}
 
 	var coverage map[string][2]*step.Vector
-	if *covRep != "" {
+	if *covRep != "" || *covBed != "" {
 		coverage = make(map[string][2]*step.Vector)
 	}
 
-	const tag = "Annot"
+	// Features are annotated by a pool of workers, each with
+	// its own scratch space. Results are written in input order.
 	var (
-		blank = `"` + strings.Repeat("-", mapLen)
-
-		buffer  = make([]byte, 0, annotationLength)
-		mapping = buffer[1 : mapLen+1]
-		annots  = make(matches, 0, maxAnnotations+1)
-		best    = byOverlap{&annots}
-		overlap int
+		jobs    = make(chan job, *threads)
+		results = make(chan job, *threads)
+		covLock sync.Mutex
+		wg      sync.WaitGroup
 	)
-	for {
-		rf, err := target.Read()
-		if err != nil {
-			if err != io.EOF {
-				log.Fatalf("failed to read target feature: %v", err)
-			}
-			break
-		}
-		f := rf.(*gff.Feature)
-
-		overlap = int(float64(f.Len()) * minOverlap)
-		annots = annots[:0] // Obviates heap initialisation.
-		buffer = buffer[:len(blank)]
-		copy(buffer, blank)
-
-		t, ok := ts[f.SeqName]
-		if ok {
-			t.DoMatching(func(hit interval.IntInterface) (done bool) {
-				r := hit.Range()
-				heap.Push(best, match{
-					record:  hit.(*record),
-					overlap: min(r.End, f.FeatEnd) - max(r.Start, f.FeatStart),
-					strand:  f.FeatStrand,
-				})
-				if len(annots) > maxAnnotations {
-					// byOverlap is a min heap for overlap,
-					// so pop removes the lowest overlap.
-					heap.Pop(best)
+	go func() {
+		defer close(jobs)
+		for i := 0; ; i++ {
+			rf, err := target.Read()
+			if err != nil {
+				if err != io.EOF {
+					log.Fatalf("failed to read target feature: %v", err)
 				}
 				return
-			}, query{f.FeatStart, f.FeatEnd, overlap})
-		}
-
-		if len(annots) > 1 {
-			sort.Sort(byStart{annots})
+			}
+			jobs <- job{index: i, feat: rf.(*gff.Feature)}
 		}
-		if *covRep != "" {
-			for _, a := range annots {
-				if a.record.left == none {
-					continue
-				}
-				v, ok := coverage[a.record.name]
-				if !ok {
-					for i := range v {
-						v[i], err = step.New(0, a.record.right+a.record.remains, stepBool(false))
-						if err != nil {
-							panic(err)
-						}
-						v[i].Relaxed = true // This should not be required, but RepeatMasker.
-					}
-					coverage[a.record.name] = v
-				}
+	}()
+	for i := 0; i < *threads; i++ {
+		an := newAnnotator(ts, *maxAnnotations, *mapLen, *gff3, coverage, &covLock)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.fields, j.hits = an.annotate(j.feat)
+				results <- j
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[int]job)
+	next := 0
+	for r := range results {
+		pending[r.index] = r
+		for {
+			j, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
 
-				// krishna coverage.
-				left := a.record.left + max(0, f.FeatStart-a.record.genomic.Start())
-				right := a.record.right + min(0, f.FeatEnd-a.record.genomic.End())
-				if right < left { // This craziness is... because RepeatMasker.
-					continue
+			if js != nil {
+				err = writeJSON(js, j.feat, j.fields)
+				if err != nil {
+					log.Fatalf("failed to write JSON: %v", err)
 				}
-				v[1].SetRange(left, right, stepBool(true))
+			}
+			if sum != nil {
+				sum.add(j)
+			} else {
+				out.Write(j.feat)
 			}
 		}
-
-		if len(annots) > 0 {
-			buffer = makeAnnot(f, annots, mapping, bytes.NewBuffer(buffer))
+	}
+	if sum != nil {
+		err = sum.writeTo(w)
+		if err != nil {
+			log.Fatalf("failed to write summary: %v", err)
 		}
-
-		buffer = append(buffer, '"')
-		f.FeatAttributes = append(f.FeatAttributes, gff.Attribute{
-			Tag:   tag,
-			Value: string(buffer),
-		})
-
-		out.Write(f)
 	}
 
-	if *covRep != "" {
+	if coverage != nil {
 		// RepeatMasker coverage for repeat types seen by krishna.
 		for _, t := range ts {
 			t.Do(func(iv interval.IntInterface) (done bool) {
 				rec := iv.(*record)
-				if rec.left == none || rec.right < rec.left { // RepeatMasker...
+				if rec.left == none {
 					return
 				}
-				if v, ok := coverage[rec.name]; ok {
-					v[0].SetRange(rec.left, rec.right, stepBool(true))
+				v, ok := coverage[rec.coverageKey()]
+				if !ok {
+					return
+				}
+				left, right, ok := orient(rec, rec.left, rec.right)
+				if !ok { // RepeatMasker...
+					return
 				}
+				v[0].SetRange(left, right, stepBool(true))
 				return
 			})
 		}
+	}
+	if *covRep != "" {
 		err = writeCoverage(*covRep, coverage)
 		if err != nil {
 			log.Fatalf("failed to write coverage report: %v", err)
 		}
 	}
+	if *covBed != "" {
+		err = writeCoverageBed(*covBed, coverage)
+		if err != nil {
+			log.Fatalf("failed to write coverage bedGraph: %v", err)
+		}
+	}
+}
+
+// job is a target feature and its annotations.
+type job struct {
+	// index is the position of the
+	// feature in the target input.
+	index int
+
+	feat   *gff.Feature
+	fields []annotation
+
+	// hits is the number of repeats matching
+	// the feature before the number of
+	// annotations was limited.
+	hits int
+}
+
+// annotator annotates target features with matching repeats.
+// Each annotator holds its own scratch space, so an annotator
+// must not be used concurrently.
+type annotator struct {
+	trees          trees
+	maxAnnotations int
+	mapLen         int
+	gff3           bool
+
+	// coverage is shared between annotators
+	// and is protected by covLock.
+	coverage map[string][2]*step.Vector
+	covLock  *sync.Mutex
+
+	blank  string
+	buffer []byte
+	annots matches
+	best   byOverlap
+}
+
+func newAnnotator(ts trees, maxAnnotations, mapLen int, gff3 bool, coverage map[string][2]*step.Vector, covLock *sync.Mutex) *annotator {
+	a := &annotator{
+		trees:          ts,
+		maxAnnotations: maxAnnotations,
+		mapLen:         mapLen,
+		gff3:           gff3,
+		coverage:       coverage,
+		covLock:        covLock,
+
+		blank: `"` + strings.Repeat("-", mapLen),
+		// The buffer must be able to hold the map and its
+		// quotes; it grows as needed to hold the names.
+		buffer: make([]byte, 0, max(annotationLength, mapLen+2)),
+		annots: make(matches, 0, maxAnnotations+1),
+	}
+	a.best = byOverlap{&a.annots}
+	return a
+}
+
+// annotate adds the annotation attribute to f and returns the
+// annotations of the repeats matching f and the total number of
+// matching repeats.
+func (an *annotator) annotate(f *gff.Feature) (fields []annotation, hits int) {
+	const tag = "Annot"
+
+	overlap := max(int(float64(f.Len())*minOverlap), minBases)
+	an.annots = an.annots[:0] // Obviates heap initialisation.
+	an.buffer = an.buffer[:len(an.blank)]
+	copy(an.buffer, an.blank)
+	// The mapping must be resliced since buffer may have
+	// been reallocated while appending the names.
+	mapping := an.buffer[1 : an.mapLen+1]
+
+	t, ok := an.trees[f.SeqName]
+	if ok {
+		t.DoMatching(func(hit interval.IntInterface) (done bool) {
+			r := hit.Range()
+			m := match{
+				record:  hit.(*record),
+				overlap: min(r.End, f.FeatEnd) - max(r.Start, f.FeatStart),
+				strand:  f.FeatStrand,
+			}
+			if m.element() < minElement {
+				return
+			}
+			hits++
+			heap.Push(an.best, m)
+			if len(an.annots) > an.maxAnnotations {
+				// byOverlap is a min heap for overlap,
+				// so pop removes the lowest overlap.
+				heap.Pop(an.best)
+			}
+			return
+		}, query{f.FeatStart, f.FeatEnd, overlap})
+	}
+
+	if len(an.annots) > 1 {
+		sort.Sort(byStart{an.annots})
+	}
+	if an.coverage != nil {
+		an.addCoverage(f)
+	}
+
+	if len(an.annots) > 0 {
+		fields = makeAnnot(f, an.annots, mapping)
+	}
+
+	if an.gff3 {
+		f.FeatAttributes = append(f.FeatAttributes, gff.Attribute{
+			Tag:   tag,
+			Value: string(mapping),
+		})
+		for i, a := range fields {
+			f.FeatAttributes = append(f.FeatAttributes, gff.Attribute{
+				Tag:   fmt.Sprintf("RepeatName_%d", i+1),
+				Value: a.label(),
+			})
+			if a.defined {
+				f.FeatAttributes = append(f.FeatAttributes,
+					gff.Attribute{
+						Tag:   fmt.Sprintf("MaskedCoverage_%d", i+1),
+						Value: fmt.Sprintf("%.0f", a.masked),
+					},
+					gff.Attribute{
+						Tag:   fmt.Sprintf("ElementCoverage_%d", i+1),
+						Value: fmt.Sprintf("%.0f", a.element),
+					},
+				)
+			}
+		}
+	} else {
+		b := bytes.NewBuffer(an.buffer)
+		for _, a := range fields {
+			a.writeTo(b, an.maxAnnotations > maxLetters)
+		}
+		an.buffer = append(b.Bytes(), '"')
+		f.FeatAttributes = append(f.FeatAttributes, gff.Attribute{
+			Tag:   tag,
+			Value: string(an.buffer),
+		})
+	}
+
+	return fields, hits
+}
+
+// summary is a summary of the matches to target features.
+type summary struct {
+	// counts holds the number of features with
+	// each number of matches. The last element
+	// counts features with more matches than
+	// the maximum number of annotations.
+	counts []int
+
+	// overlaps holds the number of retained
+	// matches with overlaps in [2^(i-1), 2^i).
+	overlaps []int
+}
+
+func newSummary(maxAnnotations int) *summary {
+	return &summary{counts: make([]int, maxAnnotations+2)}
+}
+
+// add adds the matches of j to the summary.
+func (s *summary) add(j job) {
+	s.counts[min(j.hits, len(s.counts)-1)]++
+	for _, a := range j.fields {
+		b := bits.Len(uint(max(a.overlap, 0)))
+		for len(s.overlaps) <= b {
+			s.overlaps = append(s.overlaps, 0)
+		}
+		s.overlaps[b]++
+	}
+}
+
+// writeTo writes histograms of match counts and overlap lengths to w.
+func (s *summary) writeTo(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(tw, "matches\tfeatures")
+	last := len(s.counts) - 1
+	for i, n := range s.counts[:last] {
+		fmt.Fprintf(tw, "%d\t%d\n", i, n)
+	}
+	fmt.Fprintf(tw, ">%d\t%d\n", last-1, s.counts[last])
+
+	fmt.Fprintln(tw, "\noverlap\tmatches")
+	for i, n := range s.overlaps {
+		if i < 2 {
+			fmt.Fprintf(tw, "%d\t%d\n", i, n)
+			continue
+		}
+		fmt.Fprintf(tw, "%d-%d\t%d\n", 1<<(i-1), 1<<i-1, n)
+	}
+	return tw.Flush()
+}
+
+// addCoverage adds the krishna coverage of the current
+// matches of the target feature f to the shared coverage.
+func (an *annotator) addCoverage(f *gff.Feature) {
+	an.covLock.Lock()
+	defer an.covLock.Unlock()
+
+	for _, a := range an.annots {
+		if a.record.left == none {
+			continue
+		}
+		key := a.record.coverageKey()
+		v, ok := an.coverage[key]
+		if !ok {
+			for i := range v {
+				var err error
+				v[i], err = step.New(0, a.record.right+a.record.remains, stepBool(false))
+				if err != nil {
+					panic(err)
+				}
+				v[i].Relaxed = true // This should not be required, but RepeatMasker.
+			}
+			an.coverage[key] = v
+		}
+
+		// krishna coverage.
+		left := a.record.left + max(0, f.FeatStart-a.record.genomic.Start())
+		right := a.record.right + min(0, f.FeatEnd-a.record.genomic.End())
+		left, right, ok = orient(a.record, left, right)
+		if !ok { // This craziness is... because RepeatMasker.
+			continue
+		}
+		v[1].SetRange(left, right, stepBool(true))
+	}
+}
+
+// orient returns the consensus interval [left, right) for rec and whether
+// it is usable. Inverted records are logged once if strict is true, and
+// are swapped if fixOrient is true or otherwise reported as unusable.
+func orient(rec *record, left, right int) (l, r int, ok bool) {
+	if left <= right {
+		return left, right, true
+	}
+	if strict && !inverted[rec.id] {
+		inverted[rec.id] = true
+		log.Printf("inverted record %d: %s %s:%d-%d consensus %d-%d",
+			len(inverted), rec.name, rec.genomic.loc.Name(), feat.ZeroToOne(rec.genomic.left), rec.genomic.right, left, right)
+	}
+	if fixOrient {
+		return right, left, true
+	}
+	return left, right, false
 }
 
 // stepBool is a bool type satisfying the step.Equaler interface.
@@ -262,13 +625,66 @@ func (b stepBool) Equal(e step.Equaler) bool {
 	return b == e.(stepBool)
 }
 
-// makeAnoot return an annotation map
-func makeAnnot(target *gff.Feature, m matches, mapping []byte, buf *bytes.Buffer) []byte {
+// annotation is the annotation of a target feature by a repeat.
+type annotation struct {
+	// index is the 1-based index of the
+	// annotation in the annotation list.
+	index int
+	name  string
+	class string
+
+	// overlap is the number of bases of
+	// overlap with the target feature.
+	overlap int
+
+	// defined indicates whether the consensus
+	// position of the repeat is known, and so
+	// whether masked and element are valid.
+	defined bool
+
+	// masked and element are the percentage of
+	// the masked element and of the complete
+	// element covered by the target feature.
+	masked, element float64
+}
+
+// label returns the name of the annotated repeat, including
+// its class in RepeatMasker name#class form if withClass is
+// true.
+func (a annotation) label() string {
+	if withClass {
+		return a.name + "#" + a.class
+	}
+	return a.name
+}
+
+// writeTo writes the GFF2 form of the annotation to buf. If numbered is
+// true, the name is preceded by the index of the annotation.
+func (a annotation) writeTo(buf *bytes.Buffer, numbered bool) {
+	buf.WriteByte(' ')
+	if numbered {
+		fmt.Fprintf(buf, "%d:", a.index)
+	}
+	buf.WriteString(a.label())
+	if a.defined {
+		fmt.Fprintf(buf, "(%.0f%%|%.0f%%)", a.masked, a.element)
+	}
+}
+
+// makeAnnot renders the annotation map of the matches, m, over the target
+// into mapping and returns the annotation for each match. The ith match is
+// represented by the ith letter of the alphabet, in upper case at ends that
+// coincide with the end of the repeat element. Matches beyond the 26th are
+// represented by '*'.
+func makeAnnot(target *gff.Feature, m matches, mapping []byte) []annotation {
+	annots := make([]annotation, 0, len(m))
 	var leftMargin, rightMargin float64
-	scale := mapLen / float64(target.Len())
-	for i, annotation := range m {
+	mapLen := len(mapping)
+	maxMargin := 1 / float64(mapLen)
+	scale := float64(mapLen) / float64(target.Len())
+	for i, match := range m {
 		var (
-			rec   = annotation.record
+			rec   = match.record
 			start = max(rec.genomic.Start(), target.FeatStart)
 			end   = min(rec.genomic.End(), target.FeatEnd)
 		)
@@ -298,8 +714,11 @@ func makeAnnot(target *gff.Feature, m matches, mapping []byte, buf *bytes.Buffer
 		}
 
 		if mapStart < mapEnd {
-			cLower := 'a' + byte(i)
-			cUpper := 'A' + byte(i)
+			cLower, cUpper := byte('*'), byte('*')
+			if i < maxLetters {
+				cLower = 'a' + byte(i)
+				cUpper = 'A' + byte(i)
+			}
 
 			if leftMargin <= maxMargin && rec.left != none {
 				mapping[mapStart] = cUpper
@@ -327,20 +746,64 @@ func makeAnnot(target *gff.Feature, m matches, mapping []byte, buf *bytes.Buffer
 			}
 		}
 
-		buf.WriteByte(' ')
-		buf.WriteString(rec.name)
-
-		if rec.left != none {
-			fmt.Fprintf(buf, "(%.0f%%|%.0f%%)",
-				// Overlap with masked element.
-				float64(annotation.overlap)/float64(rec.genomic.Len())*100,
-				// Overlap with complete element.
-				float64(annotation.overlap)/float64(rec.right+rec.remains)*100,
-			)
+		a := annotation{
+			index:   i + 1,
+			name:    rec.name,
+			class:   rec.class,
+			overlap: match.overlap,
+			defined: rec.left != none,
+		}
+		if a.defined {
+			// Overlap with masked element.
+			a.masked = float64(match.overlap) / float64(rec.genomic.Len()) * 100
+			// Overlap with complete element.
+			a.element = match.element()
 		}
+		annots = append(annots, a)
 	}
 
-	return buf.Bytes()
+	return annots
+}
+
+// jsonFeature is the JSON representation of a target feature's matches.
+type jsonFeature struct {
+	SeqName string      `json:"seqName"`
+	Start   int         `json:"start"`
+	End     int         `json:"end"`
+	Strand  string      `json:"strand"`
+	Matches []jsonMatch `json:"matches"`
+}
+
+// jsonMatch is the JSON representation of a repeat match.
+type jsonMatch struct {
+	Name    string `json:"name"`
+	Class   string `json:"class"`
+	Overlap int    `json:"overlap"`
+
+	// The coverage fields are only present when
+	// the consensus position of the repeat is known.
+	MaskedCoverage  *float64 `json:"maskedCoverage,omitempty"`
+	ElementCoverage *float64 `json:"elementCoverage,omitempty"`
+}
+
+// writeJSON writes the annotations of the target feature to enc.
+func writeJSON(enc *json.Encoder, target *gff.Feature, annots []annotation) error {
+	jf := jsonFeature{
+		SeqName: target.SeqName,
+		Start:   feat.ZeroToOne(target.FeatStart),
+		End:     target.FeatEnd,
+		Strand:  target.FeatStrand.String(),
+		Matches: make([]jsonMatch, len(annots)),
+	}
+	for i, a := range annots {
+		jf.Matches[i] = jsonMatch{Name: a.name, Class: a.class, Overlap: a.overlap}
+		if a.defined {
+			masked, element := a.masked, a.element
+			jf.Matches[i].MaskedCoverage = &masked
+			jf.Matches[i].ElementCoverage = &element
+		}
+	}
+	return enc.Encode(jf)
 }
 
 func writeCoverage(file string, coverage map[string][2]*step.Vector) error {
@@ -386,6 +849,51 @@ func writeCoverage(file string, coverage map[string][2]*step.Vector) error {
 	return nil
 }
 
+// writeCoverageBed writes the named and de novo coverage of each repeat
+// type to file as a pair of bedGraph tracks. The repeat name is used as
+// the chromosome and covered intervals of the consensus are given a value
+// of 1.
+func writeCoverageBed(file string, coverage map[string][2]*step.Vector) error {
+	if len(coverage) == 0 {
+		return nil
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+
+	names := make([]string, 0, len(coverage))
+	for n := range coverage {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for i, track := range []struct{ name, desc string }{
+		{name: "named", desc: "named coverage"},
+		{name: "de_novo", desc: "de novo coverage"},
+	} {
+		_, err = fmt.Fprintf(w, "track type=bedGraph name=%s description=%q\n", track.name, track.desc)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			coverage[n][i].Do(func(start, end int, e step.Equaler) {
+				if err != nil || !e.(stepBool) {
+					return
+				}
+				_, err = fmt.Fprintf(w, "%s\t%d\t%d\t1\n", n, start, end)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // contig is a sequence contig with repeats mapped to it.
 type contig string
 
@@ -434,14 +942,36 @@ func (r *record) Overlap(b interval.IntRange) bool {
 	return r.genomic.End() > b.Start && r.genomic.Start() < b.End
 }
 func (r *record) ID() uintptr { return r.id }
+
+// coverageKey returns the key used to group the record
+// in coverage reports.
+func (r *record) coverageKey() string {
+	if covByClass {
+		return r.name + "#" + r.class
+	}
+	return r.name
+}
 func (r *record) Range() interval.IntRange {
 	return interval.IntRange{r.genomic.Start(), r.genomic.End()}
 }
 
 const none = -1
 
+// repeatFields is the number of fields in a RepeatMasker repeat tag.
+const repeatFields = 5
+
+// parse parses the RepeatMasker repeat tag value, a, into r. If lenient
+// is true, a tag missing any of the consensus position fields is parsed
+// as having an unknown consensus position.
 func (r *record) parse(a string) error {
-	fields := strings.Split(a, " ")
+	fields := strings.Fields(a)
+	if len(fields) < 2 || len(fields) < repeatFields && !lenient {
+		return fmt.Errorf("too few fields in repeat tag %q: %d < %d", a, len(fields), repeatFields)
+	}
+	if len(fields) < repeatFields {
+		// A partial consensus position is not usable.
+		fields = append(fields[:2], ".", ".", ".")
+	}
 
 	r.name = fields[0]
 	r.class = fields[1]
@@ -476,6 +1006,8 @@ func (r *record) parse(a string) error {
 }
 
 // query is an interval query allowing for an overlap threshold.
+// Intervals must overlap the query by more than overlap bases
+// to match.
 type query struct {
 	left, right int
 	overlap     int
@@ -498,6 +1030,16 @@ type match struct {
 	strand seq.Strand
 }
 
+// element returns the percentage of the complete repeat element
+// covered by the match. If the consensus position of the repeat
+// is not known, element returns +Inf.
+func (m match) element() float64 {
+	if m.record.left == none {
+		return math.Inf(1)
+	}
+	return float64(m.overlap) / float64(m.record.right+m.record.remains) * 100
+}
+
 type matches []match
 
 func (m matches) Len() int {
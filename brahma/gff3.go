@@ -0,0 +1,80 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/biogo/biogo/feat"
+	"github.com/biogo/biogo/io/featio/gff"
+)
+
+// featureWriter is the feature writing behaviour shared by gff.Writer
+// and gff3Writer.
+type featureWriter interface {
+	Write(feat.Feature) (int, error)
+}
+
+// gff3Writer writes gff.Features as GFF3 lines, with attributes written
+// as tag=value pairs.
+type gff3Writer struct {
+	w io.Writer
+
+	// Precision is the number of decimal places
+	// used to write scores.
+	Precision int
+}
+
+// newGFF3Writer returns a new gff3Writer writing to w after writing the
+// GFF3 version header.
+func newGFF3Writer(w io.Writer, precision int) (*gff3Writer, error) {
+	_, err := fmt.Fprintln(w, "##gff-version 3")
+	return &gff3Writer{w: w, Precision: precision}, err
+}
+
+// Write writes f as a GFF3 line. Only *gff.Feature values are handled.
+func (w *gff3Writer) Write(f feat.Feature) (int, error) {
+	gf, ok := f.(*gff.Feature)
+	if !ok {
+		return 0, gff.ErrNotHandled
+	}
+	if gf.FeatStart >= gf.FeatEnd {
+		return 0, gff.ErrBadFeature
+	}
+	score := "."
+	if gf.FeatScore != nil && !math.IsNaN(*gf.FeatScore) {
+		score = fmt.Sprintf("%.*f", w.Precision, *gf.FeatScore)
+	}
+	attrs := make([]string, len(gf.FeatAttributes))
+	for i, a := range gf.FeatAttributes {
+		// GFF2 values may contain quoted strings, but
+		// GFF3 values are escaped rather than quoted.
+		v := strings.Replace(a.Value, `"`, "", -1)
+		attrs[i] = gff3Escape(a.Tag) + "=" + gff3Escape(v)
+	}
+	return fmt.Fprintf(w.w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n",
+		gff3Escape(gf.SeqName), gff3Escape(gf.Source), gff3Escape(gf.Feature),
+		feat.ZeroToOne(gf.FeatStart), gf.FeatEnd,
+		score, gf.FeatStrand, gf.FeatFrame,
+		strings.Join(attrs, ";"),
+	)
+}
+
+// gff3Escape returns s with the characters reserved by GFF3 percent-encoded.
+func gff3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c < ' ', c == 0x7f, c == ';', c == '=', c == '&', c == ',', c == '%':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -3,26 +3,68 @@
 // license that can be found in the LICENSE file.
 
 // fastatophy converts a multiple-sequence alignment in
-// FASTA to PHYLIP (sequential) format.
+// FASTA to PHYLIP (sequential) format. With -interleaved
+// the alignment is written in interleaved format, in
+// blocks of -width columns with sequence identifiers
+// given only in the first block.
+//
+// Sequence identifiers are truncated or padded to 10
+// characters as required by strict PHYLIP, or to the
+// width given by -namelen for tools that accept other
+// widths. Truncation that would make two identifiers
+// identical is reported as an error. With -relaxed,
+// full identifiers are written followed by a single
+// space, as accepted by RAxML and PhyML.
+//
+// The alignment is read twice, once to determine its
+// dimensions and once to write it. When reading from
+// stdin the entire input is therefore held in memory.
+// If the dimensions of the alignment are known, they may
+// be given with -ntax and -nchar, and the alignment is
+// then converted in a single pass without buffering, so
+// that pipes and very large files can be used. In this
+// case each sequence must be exactly -nchar long and
+// there must be exactly -ntax sequences.
+//
+// With -format=nexus, a minimal NEXUS DATA block is
+// written instead of PHYLIP, with full identifiers
+// quoted where NEXUS requires it.
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/biogo/biogo/alphabet"
 	"github.com/biogo/biogo/io/seqio"
 	"github.com/biogo/biogo/io/seqio/fasta"
 	"github.com/biogo/biogo/seq/linear"
+
+	"github.com/biogo/examples/fastatophy/phylip"
 )
 
 var (
-	inf  = flag.String("in", "", "input FASTA filename (required)")
-	outf = flag.String("out", "", "output PHYLIP filename (required)")
-	help = flag.Bool("help", false, "help prints this message")
+	inf    = flag.String("in", "", "input FASTA filename, defaults to stdin (buffered in memory)")
+	outf   = flag.String("out", "", "output filename (required)")
+	format = flag.String("format", "phylip", "output format: phylip or nexus")
+	alpha  = flag.String("alpha", "auto", "alignment alphabet: auto, dna or protein")
+	strict = flag.Bool("strict", false, "treat sequences of unequal length as an error")
+	namel  = flag.Int("namelen", phylip.StrictNameLen, "identifier width for non-relaxed PHYLIP")
+	relax  = flag.Bool("relaxed", false, "write relaxed PHYLIP with full sequence identifiers")
+	inter  = flag.Bool("interleaved", false, "write interleaved rather than sequential PHYLIP")
+	width  = flag.Int("width", 60, "column block width for interleaved output")
+	stats  = flag.Bool("stats", false, "report gapped column count and per-sequence gap fractions to stderr")
+	ntax   = flag.Int("ntax", 0, "number of sequences in the alignment; with -nchar enables single-pass conversion")
+	nchar  = flag.Int("nchar", 0, "length of the alignment; with -ntax enables single-pass conversion")
+	namesf = flag.String("names", "", "output filename for a table mapping written identifiers to original identifiers")
+	help   = flag.Bool("help", false, "help prints this message")
 )
 
 func main() {
@@ -32,77 +74,337 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *inf == "" || *outf == "" {
+	if *outf == "" {
 		flag.Usage()
 		os.Exit(1)
-	} 
-	
-	in, err := os.Open(*inf)
-	if err != nil {
-		log.Fatalf("failed to open FASTA file %q: %v", *inf, err)
 	}
-	defer in.Close()
+	var nexus bool
+	switch strings.ToLower(*format) {
+	case "phylip":
+	case "nexus":
+		nexus = true
+		if *inter || *relax {
+			log.Fatal("-interleaved and -relaxed are not supported for NEXUS output")
+		}
+	default:
+		log.Fatalf("unknown output format %q", *format)
+	}
+	if *namel < 1 {
+		log.Fatalf("invalid identifier width: %d", *namel)
+	}
+	if *inter && *width < 1 {
+		log.Fatalf("invalid interleaved block width: %d", *width)
+	}
+	stream := *ntax != 0 || *nchar != 0
+	if stream {
+		if *ntax < 1 || *nchar < 1 {
+			log.Fatalf("invalid alignment dimensions: -ntax=%d -nchar=%d", *ntax, *nchar)
+		}
+		if *inter || *stats {
+			log.Fatal("-interleaved and -stats are not supported with -ntax and -nchar")
+		}
+	}
+
+	var in io.Reader
+	switch {
+	case *inf != "":
+		f, err := os.Open(*inf)
+		if err != nil {
+			log.Fatalf("failed to open FASTA file %q: %v", *inf, err)
+		}
+		defer f.Close()
+		in = f
+	case stream:
+		in = bufio.NewReaderSize(os.Stdin, sniffLen)
+	default:
+		// The input is read twice, so stdin must be buffered.
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("failed to read stdin: %v", err)
+		}
+		in = bytes.NewReader(b)
+	}
+
+	var a alphabet.Alphabet
+	switch strings.ToLower(*alpha) {
+	case "auto":
+		var err error
+		if br, ok := in.(*bufio.Reader); ok {
+			// Stdin cannot be rewound, so sniff the
+			// alphabet from the buffered prefix.
+			b, _ := br.Peek(sniffLen)
+			a, err = sniffAlphabet(bytes.NewReader(b))
+		} else {
+			a, err = sniffAlphabet(in.(io.ReadSeeker))
+		}
+		if err != nil {
+			log.Fatalf("failed to determine alphabet: %v", err)
+		}
+	case "dna":
+		a = alphabet.DNAgapped
+	case "protein":
+		a = alphabet.Protein
+	default:
+		log.Fatalf("unknown alphabet %q", *alpha)
+	}
+
+	var (
+		dims    phylip.Dims
+		maxName int
+		seen    = make(map[string]string)
+		dups    int
+	)
+	t := linear.NewSeq("", nil, a)
+	if stream {
+		dims = phylip.Dims{NTax: *ntax, NChar: *nchar}
+	} else {
+		dims, maxName, dups = firstPass(in, t, seen, nexus)
+	}
+	if dups != 0 {
+		if !*relax && !nexus {
+			log.Fatalf("%d duplicate identifiers: consider using -relaxed", dups)
+		}
+		log.Fatalf("%d duplicate identifiers", dups)
+	}
 
 	out, err := os.Create(*outf)
 	if err != nil {
-		log.Fatalf("failed to open PHYLIP file %q: %v", *outf, err)
+		log.Fatalf("failed to open output file %q: %v", *outf, err)
 	}
 	defer out.Close()
 
-	// Read all FASTA records to get total number of sequences
-	// (n) and length of each sequence (seqlens).
-	var n int
-	var seqlens []int
-	t := linear.NewSeq("", nil, alphabet.Protein)
-	r := fasta.NewReader(in, t)
-	sc := seqio.NewScanner(r)
+	// Write the header section consisting of dimensions of
+	// the alignment to the output file.
+	if nexus {
+		err = writeNexusHeader(out, dims, t.Alphabet())
+	} else {
+		err = phylip.WriteHeader(out, dims)
+	}
+	if err != nil {
+		log.Fatalf("failed to write header: %v", err)
+	}
+
+	var nameTab *bufio.Writer
+	if *namesf != "" {
+		f, err := os.Create(*namesf)
+		if err != nil {
+			log.Fatalf("failed to create names file %q: %v", *namesf, err)
+		}
+		defer f.Close()
+		nameTab = bufio.NewWriter(f)
+		defer nameTab.Flush()
+	}
+
+	if !stream {
+		// Reinitialize to read from the start of the FASTA file
+		// and write the alignment section to the PHYLIP file.
+		_, err = in.(io.Seeker).Seek(0, io.SeekStart)
+		if err != nil {
+			log.Fatalf("seek failed: %v", err)
+		}
+	}
+	sc := seqio.NewScanner(fasta.NewReader(in, t))
+	// Sequence identifiers must be exactly -namelen characters,
+	// 10 in "strict" PHYLIP format. Relaxed identifiers are only
+	// padded when interleaved, so that blocks are aligned.
+	nameLen := *namel
+	if *relax {
+		nameLen = 0
+		if *inter {
+			nameLen = maxName
+		}
+	}
+	var (
+		n     int
+		names []string
+		seqs  [][]alphabet.Letter
+	)
+	for sc.Next() {
+		s := sc.Seq().(*linear.Seq)
+		if stream {
+			// The header has already been written, so the
+			// alignment must match it exactly.
+			n++
+			if n > dims.NTax {
+				log.Fatalf("more than %d sequences in alignment", dims.NTax)
+			}
+			if s.Len() != dims.NChar {
+				log.Fatalf("%s length (%d) differs from -nchar (%d)", s.Name(), s.Len(), dims.NChar)
+			}
+			id := phylipID(s.Name(), nexus)
+			if prev, ok := seen[id]; ok {
+				log.Fatalf("%s and %s have the same identifier %q", prev, s.Name(), id)
+			}
+			seen[id] = s.Name()
+		}
+		if nexus {
+			if nameTab != nil {
+				fmt.Fprintf(nameTab, "%s\t%s\n", nexusName(s.Name()), s.Name())
+			}
+			err = writeNexusSeq(out, s.Name(), s.Seq)
+			if err != nil {
+				log.Fatalf("failed to write %s: %v", s.Name(), err)
+			}
+			continue
+		}
+		name, truncated := phylip.Name(s.Name(), nameLen, *relax)
+		if truncated {
+			log.Printf("Identifier: %s was truncated to %d characters\n", s.Name(), nameLen)
+		}
+		if nameTab != nil {
+			fmt.Fprintf(nameTab, "%s\t%s\n", strings.TrimRight(name, " "), s.Name())
+		}
+		if *inter {
+			// Interleaved blocks span all sequences, so
+			// hold them until all have been read.
+			names = append(names, name)
+			seqs = append(seqs, s.Seq)
+			continue
+		}
+		err = phylip.WriteSeq(out, name, s.Seq)
+		if err != nil {
+			log.Fatalf("failed to write %s: %v", s.Name(), err)
+		}
+	}
+	err = sc.Error()
+	if err != nil {
+		log.Fatalf("failed during second read: %v", err)
+	}
+	if stream && n != dims.NTax {
+		log.Fatalf("alignment has %d sequences, but -ntax is %d", n, dims.NTax)
+	}
+
+	if *inter {
+		err = phylip.WriteInterleaved(out, names, seqs, *width)
+		if err != nil {
+			log.Fatalf("failed to write interleaved alignment: %v", err)
+		}
+	}
+	if nexus {
+		err = writeNexusFooter(out)
+		if err != nil {
+			log.Fatalf("failed to write NEXUS footer: %v", err)
+		}
+	}
+}
+
+// phylipID returns the identifier that will be written for the
+// sequence name, used to check that written identifiers are unique.
+func phylipID(name string, nexus bool) string {
+	if !*relax && !nexus && len(name) > *namel {
+		return name[:*namel]
+	}
+	return name
+}
+
+// firstPass reads all FASTA records from in to get the total
+// number of sequences and the length of each sequence, and checks
+// that the written identifiers will be unique, recording them in
+// seen. It returns the alignment dimensions, the length of the
+// longest identifier and the number of duplicate identifiers.
+func firstPass(in io.Reader, t *linear.Seq, seen map[string]string, nexus bool) (dims phylip.Dims, maxName, dups int) {
+	var (
+		prevLen int
+
+		// allGap records whether each column of the
+		// alignment is gap in all sequences.
+		allGap []bool
+	)
+	sc := seqio.NewScanner(fasta.NewReader(in, t))
 	for sc.Next() {
 		s := sc.Seq()
-		seqlens = append(seqlens, s.Len())
+		if len(s.Name()) > maxName {
+			maxName = len(s.Name())
+		}
+		id := phylipID(s.Name(), nexus)
+		if prev, ok := seen[id]; ok {
+			log.Printf("%s and %s have the same PHYLIP identifier %q\n", prev, s.Name(), id)
+			dups++
+		} else {
+			seen[id] = s.Name()
+		}
 		// Assert that each sequence in the multiple-sequence
 		// alignment is of equal length.
-		if n > 0 {
-			if s.Len() != seqlens[n-1] {
-				log.Printf("%s length (%d) differs from previous sequence (%d) \n", s.Name(), s.Len(), seqlens[n-1])
+		if dims.NTax > 0 && s.Len() != prevLen {
+			log.Printf("%s length (%d) differs from previous sequence (%d) \n", s.Name(), s.Len(), prevLen)
+		}
+		if *stats {
+			ls := s.(*linear.Seq)
+			if dims.NTax == 0 {
+				allGap = make([]bool, ls.Len())
+				for i := range allGap {
+					allGap[i] = true
+				}
+			}
+			gap := ls.Alphabet().Gap()
+			var gaps int
+			for i, l := range ls.Seq {
+				if l == gap {
+					gaps++
+				} else if i < len(allGap) {
+					allGap[i] = false
+				}
 			}
+			var frac float64
+			if ls.Len() != 0 {
+				frac = float64(gaps) / float64(ls.Len())
+			}
+			log.Printf("%s gap fraction: %.3f\n", s.Name(), frac)
 		}
-		n++
+		dims.Add(s.Name(), s.Len())
+		prevLen = s.Len()
 	}
-	err = sc.Error()
+	err := sc.Error()
 	if err != nil {
 		log.Fatalf("failed during first read: %v", err)
 	}
+	if *stats {
+		var n int
+		for _, g := range allGap {
+			if g {
+				n++
+			}
+		}
+		log.Printf("%d of %d columns are fully gapped\n", n, len(allGap))
+	}
+	if err = dims.Err(); err != nil && (dims.NTax == 0 || *strict || *inter || nexus) {
+		log.Fatal(err)
+	}
+	return dims, maxName, dups
+}
 
-	// Write the header section consisting of dimensions of
-	// the alignment to the PHYLIP file.
-	fmt.Fprintf(out, "%d %d\n", n, seqlens[n-1])
+// sniffLen is the number of bytes of stdin that are examined to
+// determine the alphabet when the input cannot be rewound.
+const sniffLen = 1 << 16
 
-	// Reinitialize to read from the start of the FASTA file
-	// and write the alignment section to the PHYLIP file.
-	_, err = in.Seek(0, io.SeekStart)
+// sniffAlphabet returns the alphabet of the first sequence read from r,
+// and then seeks r back to the start. The sequence is considered to be
+// DNA if at least 90% of its non-gap letters are A, C, G, T or N, and
+// protein otherwise.
+func sniffAlphabet(r io.ReadSeeker) (alphabet.Alphabet, error) {
+	s, err := fasta.NewReader(r, linear.NewSeq("", nil, alphabet.Protein)).Read()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
 	if err != nil {
-		log.Fatalf("seek failed: %v", err)
+		return nil, err
 	}
-	r = fasta.NewReader(in, t)
-	sc = seqio.NewScanner(r)
-	var strictName string
-	for sc.Next() {
-		s := sc.Seq().(*linear.Seq)
-		// Sequence identifiers must be exactly 10 characters in
-		// "strict" PHYLIP format, truncate to first 10 characters
-		// if identifiers are longer, otherwise pad them with
-		// spaces.
-		if len(s.Name()) > 10 {
-			strictName = s.Name()[:10]
-			log.Printf("Identifier: %s was truncated to 10 characters\n", s.Name())
-		} else {
-			const padding = "          " // Ten spaces.
-			strictName = s.Name() + padding[:10-len(s.Name())]
+	if s == nil {
+		return alphabet.Protein, nil
+	}
+	var nuc, n int
+	for _, l := range s.(*linear.Seq).Seq {
+		switch l | ' ' {
+		case '-', '.', '?':
+			continue
+		case 'a', 'c', 'g', 't', 'n':
+			nuc++
 		}
-		fmt.Fprintf(out, "%s %v\n", strictName, s.Seq)
+		n++
 	}
-	err = sc.Error()
-	if err != nil {
-		log.Fatalf("failed during second read: %v", err)
+	if n != 0 && nuc*10 >= n*9 {
+		return alphabet.DNAgapped, nil
 	}
+	return alphabet.Protein, nil
 }
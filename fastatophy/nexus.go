@@ -0,0 +1,56 @@
+// Copyright ©2017 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/feat"
+
+	"github.com/biogo/examples/fastatophy/phylip"
+)
+
+// writeNexusHeader writes the start of a NEXUS DATA block for an
+// alignment with the given dimensions and alphabet to w.
+func writeNexusHeader(w io.Writer, d phylip.Dims, a alphabet.Alphabet) error {
+	datatype := "PROTEIN"
+	switch a.Moltype() {
+	case feat.DNA:
+		datatype = "DNA"
+	case feat.RNA:
+		datatype = "RNA"
+	}
+	_, err := fmt.Fprintf(w, "#NEXUS\n\nBEGIN DATA;\n"+
+		"\tDIMENSIONS NTAX=%d NCHAR=%d;\n"+
+		"\tFORMAT DATATYPE=%s MISSING=? GAP=-;\n"+
+		"\tMATRIX\n",
+		d.NTax, d.NChar, datatype)
+	return err
+}
+
+// writeNexusSeq writes a NEXUS MATRIX row for the sequence s with the
+// identifier id to w.
+func writeNexusSeq(w io.Writer, id string, s []alphabet.Letter) error {
+	_, err := fmt.Fprintf(w, "\t%s %s\n", nexusName(id), alphabet.Letters(s))
+	return err
+}
+
+// writeNexusFooter writes the end of a NEXUS DATA block to w.
+func writeNexusFooter(w io.Writer) error {
+	_, err := io.WriteString(w, "\t;\nEND;\n")
+	return err
+}
+
+// nexusName returns id quoted if it contains white space or NEXUS
+// punctuation. Single quotes within a quoted name are doubled.
+func nexusName(id string) string {
+	if id != "" && !strings.ContainsAny(id, " \t\n\r()[]{}/\\,;:=*'\"`+-<>") {
+		return id
+	}
+	return "'" + strings.Replace(id, "'", "''", -1) + "'"
+}
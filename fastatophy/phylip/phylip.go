@@ -0,0 +1,134 @@
+// Copyright ©2017 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package phylip provides support for writing multiple sequence
+// alignments in PHYLIP format.
+package phylip
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/biogo/biogo/alphabet"
+)
+
+// StrictNameLen is the identifier width required by strict PHYLIP.
+const StrictNameLen = 10
+
+// Dims holds the dimensions of an alignment.
+type Dims struct {
+	// NTax is the number of sequences in the alignment.
+	NTax int
+	// NChar is the length of the first sequence in the
+	// alignment.
+	NChar int
+
+	// Ragged holds the identifiers and lengths of sequences
+	// that differ in length from the first sequence.
+	Ragged []Seq
+}
+
+// Seq is a sequence identifier and length.
+type Seq struct {
+	ID  string
+	Len int
+}
+
+// Add adds a sequence with the given identifier and length to the
+// alignment dimensions.
+func (d *Dims) Add(id string, length int) {
+	if d.NTax == 0 {
+		d.NChar = length
+	} else if length != d.NChar {
+		d.Ragged = append(d.Ragged, Seq{ID: id, Len: length})
+	}
+	d.NTax++
+}
+
+// Err returns an error if the alignment is empty or if any sequence
+// differs in length from the first.
+func (d *Dims) Err() error {
+	if d.NTax == 0 {
+		return fmt.Errorf("phylip: no sequences")
+	}
+	if len(d.Ragged) == 0 {
+		return nil
+	}
+	r := make([]string, len(d.Ragged))
+	for i, s := range d.Ragged {
+		r[i] = fmt.Sprintf("%s (%d)", s.ID, s.Len)
+	}
+	return fmt.Errorf("phylip: alignment is not rectangular: %d sequences differ in length from the first (%d): %s",
+		len(d.Ragged), d.NChar, strings.Join(r, ", "))
+}
+
+// Name returns the PHYLIP identifier for id. If relaxed is false, the
+// identifier is truncated or space padded to exactly width characters
+// as required by strict PHYLIP, and truncated reports whether id was
+// truncated. If relaxed is true, id is padded to width if it is shorter,
+// and is never truncated.
+func Name(id string, width int, relaxed bool) (name string, truncated bool) {
+	if len(id) > width {
+		if relaxed {
+			return id, false
+		}
+		return id[:width], true
+	}
+	return id + strings.Repeat(" ", width-len(id)), false
+}
+
+// WriteHeader writes the PHYLIP dimensions line for d to w.
+func WriteHeader(w io.Writer, d Dims) error {
+	_, err := fmt.Fprintf(w, "%d %d\n", d.NTax, d.NChar)
+	return err
+}
+
+// WriteSeq writes a sequential PHYLIP record for the sequence s with
+// the identifier name to w.
+func WriteSeq(w io.Writer, name string, s []alphabet.Letter) error {
+	_, err := fmt.Fprintf(w, "%s %s\n", name, alphabet.Letters(s))
+	return err
+}
+
+// WriteInterleaved writes the aligned sequences, seqs, to w in
+// interleaved PHYLIP blocks of width columns. The sequence names
+// are written only in the first block and subsequent blocks are
+// separated by a blank line and indented to align with the first.
+func WriteInterleaved(w io.Writer, names []string, seqs [][]alphabet.Letter, width int) error {
+	if len(seqs) != len(names) {
+		return fmt.Errorf("phylip: name and sequence count mismatch: %d != %d", len(names), len(seqs))
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+	if width < 1 {
+		return fmt.Errorf("phylip: invalid block width: %d", width)
+	}
+	padding := strings.Repeat(" ", len(names[0]))
+	for start := 0; start < len(seqs[0]); start += width {
+		end := start + width
+		if end > len(seqs[0]) {
+			end = len(seqs[0])
+		}
+		if start != 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		for i, s := range seqs {
+			if len(s) != len(seqs[0]) {
+				return fmt.Errorf("phylip: sequence %d length (%d) differs from first (%d)", i, len(s), len(seqs[0]))
+			}
+			name := padding
+			if start == 0 {
+				name = names[i]
+			}
+			if err := WriteSeq(w, name, s[start:end]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright ©2017 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package phylip
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/biogo/biogo/alphabet"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestDims(c *check.C) {
+	for i, t := range []struct {
+		seqs   []Seq
+		ntax   int
+		nchar  int
+		ragged []Seq
+		err    bool
+	}{
+		{
+			seqs: nil,
+			err:  true,
+		},
+		{
+			seqs:  []Seq{{"a", 5}, {"b", 5}, {"c", 5}},
+			ntax:  3,
+			nchar: 5,
+		},
+		{
+			// The dimensions must not be taken from the last sequence.
+			seqs:   []Seq{{"a", 5}, {"b", 4}, {"c", 6}},
+			ntax:   3,
+			nchar:  5,
+			ragged: []Seq{{"b", 4}, {"c", 6}},
+			err:    true,
+		},
+	} {
+		var d Dims
+		for _, s := range t.seqs {
+			d.Add(s.ID, s.Len)
+		}
+		c.Check(d.NTax, check.Equals, t.ntax, check.Commentf("Test %d", i))
+		c.Check(d.NChar, check.Equals, t.nchar, check.Commentf("Test %d", i))
+		c.Check(d.Ragged, check.DeepEquals, t.ragged, check.Commentf("Test %d", i))
+		c.Check(d.Err() != nil, check.Equals, t.err, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestName(c *check.C) {
+	for i, t := range []struct {
+		id        string
+		width     int
+		relaxed   bool
+		name      string
+		truncated bool
+	}{
+		{id: "short", width: 10, name: "short     "},
+		{id: "exactly10c", width: 10, name: "exactly10c"},
+		{id: "longer_than_10", width: 10, name: "longer_tha", truncated: true},
+		{id: "longer_than_10", width: 10, relaxed: true, name: "longer_than_10"},
+		{id: "short", width: 8, relaxed: true, name: "short   "},
+		{id: "short", width: 0, relaxed: true, name: "short"},
+	} {
+		name, truncated := Name(t.id, t.width, t.relaxed)
+		c.Check(name, check.Equals, t.name, check.Commentf("Test %d", i))
+		c.Check(truncated, check.Equals, t.truncated, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestWrite(c *check.C) {
+	var buf bytes.Buffer
+	err := WriteHeader(&buf, Dims{NTax: 2, NChar: 4})
+	c.Assert(err, check.Equals, nil)
+	err = WriteSeq(&buf, "a         ", alphabet.BytesToLetters([]byte("AC-T")))
+	c.Assert(err, check.Equals, nil)
+	err = WriteSeq(&buf, "b         ", alphabet.BytesToLetters([]byte("ACGT")))
+	c.Assert(err, check.Equals, nil)
+	c.Check(buf.String(), check.Equals, "2 4\n"+
+		"a          AC-T\n"+
+		"b          ACGT\n")
+}
+
+func (s *S) TestWriteInterleaved(c *check.C) {
+	names := []string{"a  ", "bcd"}
+	seqs := [][]alphabet.Letter{
+		alphabet.BytesToLetters([]byte("ACGTACG")),
+		alphabet.BytesToLetters([]byte("AC-TAC-")),
+	}
+	var buf bytes.Buffer
+	err := WriteInterleaved(&buf, names, seqs, 3)
+	c.Assert(err, check.Equals, nil)
+	c.Check(buf.String(), check.Equals, ""+
+		"a   ACG\n"+
+		"bcd AC-\n"+
+		"\n"+
+		"    TAC\n"+
+		"    TAC\n"+
+		"\n"+
+		"    G\n"+
+		"    -\n")
+
+	seqs[1] = seqs[1][:6]
+	err = WriteInterleaved(&buf, names, seqs, 3)
+	c.Check(err, check.NotNil)
+}
@@ -4,21 +4,35 @@
 
 // Fetch is a simple illustration of using biogo.entrez to retrieve a large
 // set of sequences to a file.
+//
+// If an NCBI API key is provided with -apikey, it is sent to NCBI with each
+// request and the request rate limit is raised from 3 to 10 requests per
+// second. Requests, including retries, are paced to stay within the limit;
+// the interval between requests can be increased with -delay.
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/biogo/ncbi"
 	"github.com/biogo/ncbi/entrez"
 )
 
 const (
-	db    = "protein"
 	query = `"reverse transcriptase" or "transposon" or "repetitive element" or ` +
 		`"RNA-directed DNA polymerase" or "pol protein" or "non-LTR retrotransposon" or ` +
 		`"mobile element" or "retroelement" or "polyprotein" or "retrovirus" or ` +
@@ -27,13 +41,42 @@ const (
 	tool = "biogo.example"
 )
 
+// databases is the set of Entrez databases accepted by the -db flag.
+var databases = map[string]bool{
+	"assembly":   true,
+	"bioproject": true,
+	"biosample":  true,
+	"gene":       true,
+	"genome":     true,
+	"ipg":        true,
+	"nuccore":    true,
+	"nucest":     true,
+	"nucgss":     true,
+	"nucleotide": true,
+	"popset":     true,
+	"protein":    true,
+	"pubmed":     true,
+	"sra":        true,
+	"structure":  true,
+	"taxonomy":   true,
+}
+
 var (
+	db      = flag.String("db", "protein", "db specifies the Entrez database to search and retrieve from.")
 	clQuery = flag.String("query", query, "query specifies the search query for record retrieval.")
+	qFile   = flag.String("queryfile", "", "queryfile specifies a file to read the search query from (- for stdin), overriding -query.")
 	rettype = flag.String("rettype", "fasta", "rettype specifies the format of the returned data.")
 	retmax  = flag.Int("retmax", 500, "retmax specifies the number of records to be retrieved per request.")
-	out     = flag.String("out", "", "out specifies destination of the returned data (default to stdout).")
+	out     = flag.String("out", "", "out specifies destination of the returned data (default to stdout). Output is gzipped if the name ends in .gz.")
 	email   = flag.String("email", "", "email specifies the email address to be sent to the server (required).")
 	retries = flag.Int("retry", 5, "retry specifies the number of attempts to retrieve the data.")
+	apiKey  = flag.String("apikey", "", "apikey specifies an NCBI API key to send with requests, allowing a higher request rate.")
+	delay   = flag.Duration("delay", 0, "delay specifies the minimum time between requests (default 1/3s, or 1/10s with -apikey).")
+	minWait = flag.Duration("backoff", time.Second, "backoff specifies the initial wait before retrying a failed request.")
+	maxWait = flag.Duration("maxbackoff", time.Minute, "maxbackoff specifies the maximum wait before retrying a failed request.")
+	mfst    = flag.String("manifest", "", "manifest specifies a file to write the id and uncompressed output offset of each retrieved FASTA record to.")
+	split   = flag.Int("split", 0, "split specifies the number of records to write to each numbered output file, a multiple of retmax (requires -out).")
+	chkpt   = flag.String("checkpoint", "", "checkpoint specifies a file used to record progress and resume an interrupted retrieval (requires -out).")
 	help    = flag.Bool("help", false, "help prints this message.")
 )
 
@@ -50,42 +93,171 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if !databases[*db] {
+		var known []string
+		for k := range databases {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		log.Printf("error: unsupported database %q: must be one of %s\n", *db, strings.Join(known, ", "))
+		os.Exit(1)
+	}
+
+	if *qFile != "" {
+		q, err := readQuery(*qFile)
+		if err != nil {
+			log.Printf("error: failed to read query: %v\n", err)
+			os.Exit(1)
+		}
+		if q == "" {
+			log.Printf("error: empty query in %q\n", *qFile)
+			os.Exit(1)
+		}
+		*clQuery = q
+	}
+
+	if *retmax < 1 {
+		log.Println("error: -retmax must be positive")
+		os.Exit(1)
+	}
+	if *split < 0 || (*split != 0 && *out == "") {
+		log.Println("error: -split must be non-negative and requires -out")
+		os.Exit(1)
+	}
+	if *split%*retmax != 0 {
+		log.Printf("error: -split (%d) must be a multiple of -retmax (%d)\n", *split, *retmax)
+		os.Exit(1)
+	}
+
+	if *chkpt != "" && *out == "" {
+		log.Println("error: -checkpoint requires -out")
+		os.Exit(1)
+	}
+
+	var cp *checkpoint
+	if *chkpt != "" {
+		var err error
+		cp, err = readCheckpoint(*chkpt)
+		if err != nil {
+			log.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		if cp != nil && (cp.DB != *db || cp.Query != *clQuery || cp.RetType != *rettype) {
+			log.Printf("error: checkpoint %q does not match the current db, query and rettype\n", *chkpt)
+			os.Exit(1)
+		}
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	if *delay < 0 {
+		log.Println("error: -delay must not be negative")
+		os.Exit(1)
+	}
+	switch {
+	case *delay != 0:
+		entrez.Limit = ncbi.NewLimiter(*delay)
+	case *apiKey != "":
+		entrez.Limit = ncbi.NewLimiter(time.Second / 10)
+	}
 
 	h := entrez.History{}
-	s, err := entrez.DoSearch(db, *clQuery, nil, &h, tool, *email)
+	s, err := entrez.DoSearch(*db, *clQuery, &entrez.Parameters{APIKey: *apiKey}, &h, tool, *email)
 	if err != nil {
 		log.Printf("error: %v\n", err)
 		os.Exit(1)
 	}
 	log.Printf("will retrieve %d records.\n", s.Count)
 
-	var of *os.File
-	if *out == "" {
+	var (
+		of      *os.File
+		ofName  = *out
+		start   int
+		written int64 // Uncompressed bytes of output.
+		resume  = cp != nil
+	)
+	if resume {
+		start = cp.RetStart
+		written = cp.Written
+		log.Printf("resuming from record %d.\n", start)
+	}
+	switch {
+	case *out == "":
 		of = os.Stdout
-	} else {
-		of, err = os.Create(*out)
+	case *split != 0:
+		// Output files are opened per batch.
+		defer func() {
+			if of != nil {
+				of.Close()
+			}
+		}()
+	default:
+		of, err = openOutput(*out, cp)
 		if err != nil {
 			log.Printf("error: %v\n", err)
 			os.Exit(1)
 		}
 		defer of.Close()
 	}
+	gzipped := *out != "" && filepath.Ext(*out) == ".gz"
+
+	var mf *os.File
+	if *mfst != "" {
+		if resume {
+			mf, err = os.OpenFile(*mfst, os.O_WRONLY, 0)
+			if err == nil {
+				err = mf.Truncate(cp.Manifest)
+			}
+			if err == nil {
+				_, err = mf.Seek(cp.Manifest, io.SeekStart)
+			}
+		} else {
+			mf, err = os.Create(*mfst)
+			if err == nil {
+				_, err = fmt.Fprintf(mf, "# db: %s\n# query: %s\n#id\toffset",
+					*db, strings.Join(strings.Fields(*clQuery), " "))
+				if err == nil && *split != 0 {
+					_, err = fmt.Fprint(mf, "\tfile")
+				}
+				if err == nil {
+					_, err = fmt.Fprintln(mf)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		defer mf.Close()
+	}
+	if *chkpt != "" && cp == nil {
+		cp = &checkpoint{DB: *db, Query: *clQuery, RetType: *rettype}
+	}
 
 	var (
 		buf   = &bytes.Buffer{}
-		p     = &entrez.Parameters{RetMax: *retmax, RetType: *rettype, RetMode: "text"}
+		p     = &entrez.Parameters{RetMax: *retmax, RetType: *rettype, RetMode: "text", APIKey: *apiKey}
 		bn, n int64
+
+		// records is the number of FASTA records retrieved.
+		records int
+		isFasta = strings.HasPrefix(*rettype, "fasta")
 	)
-	for p.RetStart = 0; p.RetStart < s.Count; p.RetStart += p.RetMax {
+	for p.RetStart = start; p.RetStart < s.Count; p.RetStart += p.RetMax {
 		log.Printf("attempting to retrieve %d records starting from %d with %d retries.\n", p.RetMax, p.RetStart, *retries)
 		var t int
 		for t = 0; t < *retries; t++ {
+			if t != 0 {
+				d := backoff(t, *minWait, *maxWait)
+				log.Printf("backing off for %v before attempt %d.\n", d, t)
+				time.Sleep(d)
+			}
 			buf.Reset()
 			var (
 				r   io.ReadCloser
 				_bn int64
 			)
-			r, err = entrez.Fetch(db, p, tool, *email, &h)
+			r, err = entrez.Fetch(*db, p, tool, *email, &h)
 			if err != nil {
 				if r != nil {
 					r.Close()
@@ -106,14 +278,244 @@ func main() {
 		}
 
 		log.Printf("retrieved records with %d retries... writing out.\n", t)
-		_n, err := io.Copy(of, buf)
+		if isFasta {
+			records += countRecords(buf.Bytes())
+		}
+		if *split != 0 && (of == nil || p.RetStart%*split == 0) {
+			if of != nil {
+				err = of.Close()
+				if err != nil {
+					log.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			// Only a partially written file is resumed.
+			var part *checkpoint
+			if resume && p.RetStart == start && start%*split != 0 {
+				part = cp
+			} else {
+				written = 0
+			}
+			ofName = splitName(*out, p.RetStart / *split)
+			of, err = openOutput(ofName, part)
+			if err != nil {
+				log.Printf("error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if mf != nil {
+			var file string
+			if *split != 0 {
+				file = ofName
+			}
+			err = writeManifest(mf, buf.Bytes(), written, file)
+			if err != nil {
+				log.Printf("failed to write manifest: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		_n, err := writeBatch(of, buf, gzipped)
 		n += _n
+		written += _n
 		if err != nil {
 			log.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
+
+		if cp != nil {
+			cp.RetStart = p.RetStart + p.RetMax
+			cp.Written = written
+			cp.Offset, err = of.Seek(0, io.SeekCurrent)
+			if err == nil && mf != nil {
+				cp.Manifest, err = mf.Seek(0, io.SeekCurrent)
+			}
+			if err == nil {
+				err = cp.write(*chkpt)
+			}
+			if err != nil {
+				log.Printf("failed to write checkpoint: %v\n", err)
+				os.Exit(1)
+			}
+		}
 	}
 	if bn != n {
 		log.Printf("writethrough mismatch: %d != %d\n", bn, n)
 	}
+	if isFasta && records != s.Count-start {
+		log.Printf("warning: record count mismatch: expected %d records but retrieved %d\n", s.Count-start, records)
+	}
+}
+
+// openOutput opens the named output file. If cp is not nil, the file is
+// truncated to the length recorded by the checkpoint to discard any
+// partially written batch and is opened for appending. Otherwise the file
+// is created.
+func openOutput(name string, cp *checkpoint) (*os.File, error) {
+	if cp == nil {
+		return os.Create(name)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(cp.Offset)
+	if err == nil {
+		_, err = f.Seek(cp.Offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// splitName returns the name of the ith split output file derived from
+// name by inserting a zero-padded index before the file extension.
+func splitName(name string, i int) string {
+	var gz string
+	if filepath.Ext(name) == ".gz" {
+		gz = ".gz"
+		name = strings.TrimSuffix(name, gz)
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.%06d%s%s", strings.TrimSuffix(name, ext), i, ext, gz)
+}
+
+// writeManifest writes the id and offset of each FASTA record in b to w.
+// The offset of the start of b in the output is given by base. If file is
+// not empty, it is written as a third column.
+func writeManifest(w io.Writer, b []byte, base int64, file string) error {
+	bw := bufio.NewWriter(w)
+	for off := 0; off < len(b); {
+		end := bytes.IndexByte(b[off:], '\n')
+		if end < 0 {
+			end = len(b)
+		} else {
+			end += off
+		}
+		line := b[off:end]
+		if len(line) != 0 && line[0] == '>' {
+			var id []byte
+			if f := bytes.Fields(line[1:]); len(f) != 0 {
+				id = f[0]
+			}
+			if file == "" {
+				fmt.Fprintf(bw, "%s\t%d\n", id, base+int64(off))
+			} else {
+				fmt.Fprintf(bw, "%s\t%d\t%s\n", id, base+int64(off), file)
+			}
+		}
+		off = end + 1
+	}
+	return bw.Flush()
+}
+
+// countRecords returns the number of FASTA records in b.
+func countRecords(b []byte) int {
+	n := bytes.Count(b, []byte("\n>"))
+	if len(b) != 0 && b[0] == '>' {
+		n++
+	}
+	return n
+}
+
+// readQuery returns the query held in the named file, or stdin if name
+// is "-", with leading and trailing white space removed.
+func readQuery(name string) (string, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if name == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(name)
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+// backoff returns the wait before retry attempt t, doubling from base
+// with each attempt up to max. The returned wait is jittered uniformly
+// over the upper half of the interval to avoid synchronised retries.
+func backoff(t int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < t && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// writeBatch writes the contents of buf to f, returning the number of
+// uncompressed bytes written. If gzipped is true, the batch is written
+// as a complete gzip member so that the output remains a valid gzip
+// stream, and can be truncated at a batch boundary when resuming from
+// a checkpoint. The gzip writer is closed before writeBatch returns,
+// even if the write fails.
+func writeBatch(f *os.File, buf *bytes.Buffer, gzipped bool) (int64, error) {
+	if !gzipped {
+		return io.Copy(f, buf)
+	}
+	gz := gzip.NewWriter(f)
+	n, err := io.Copy(gz, buf)
+	cerr := gz.Close()
+	if err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// checkpoint records the progress of a retrieval so that it can be resumed.
+type checkpoint struct {
+	DB      string
+	Query   string
+	RetType string
+
+	// RetStart is the index of the next record to retrieve.
+	RetStart int
+	// Offset is the length of the output file written up to RetStart.
+	Offset int64
+	// Written is the uncompressed length of the output written up
+	// to RetStart.
+	Written int64
+	// Manifest is the length of the manifest file written up to
+	// RetStart.
+	Manifest int64
+}
+
+// readCheckpoint reads the checkpoint in the named file. If the file
+// does not exist, readCheckpoint returns a nil checkpoint and error.
+func readCheckpoint(name string) (*checkpoint, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cp checkpoint
+	err = json.Unmarshal(b, &cp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %q: %v", name, err)
+	}
+	return &cp, nil
+}
+
+// write atomically writes the checkpoint to the named file.
+func (cp *checkpoint) write(name string) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0664)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
 }
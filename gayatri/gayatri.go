@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
 	"runtime/pprof"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/biogo/biogo/alphabet"
@@ -23,7 +30,7 @@ import (
 
 func main() {
 	var (
-		in           *fasta.Reader
+		in           io.ReadSeeker
 		out, profile *os.File
 		err          error
 	)
@@ -31,13 +38,20 @@ func main() {
 	inName := flag.String("in", "", "Filename for input to be factorised. Defaults to stdin.")
 	outName := flag.String("out", "", "Filename for output. Defaults to stdout.")
 	k := flag.Int("k", 8, "kmer size to use.")
+	alpha := flag.String("alpha", "dna", "sequence alphabet (dna or protein).")
+	canon := flag.Bool("canon", false, "fold DNA kmers and their reverse complements into the lesser of the pair; this roughly halves the number of kmer rows and combines their weights.")
 	cat := flag.Int("cat", 5, "number of categories.")
+	catRange := flag.String("catrange", "", "range of numbers of categories to scan, lo-hi; the number at the residual elbow is used.")
 	iter := flag.Int("i", 1000, "iterations.")
 	limit := flag.Duration("time", 10*time.Second, "time limit for NMF.")
 	lo := flag.Int("lo", 1, "minimum number of kmer frequency to use in NMF.")
 	hi := flag.Float64("hi", 0.5, "maximum proportion of kmer representation to use in NMF.")
 	tol := flag.Float64("tol", 0.001, "tolerance for NMF.")
 	seed := flag.Int64("seed", -1, "seed for random number generator (-1 uses system clock).")
+	wOut := flag.String("wout", "", "write the W (kmer weight) matrix to this file as TSV.")
+	hOut := flag.String("hout", "", "write the H (sequence loading) matrix to this file as TSV.")
+	every := flag.Int("progress", 0, "log progress every n sequences during indexing (0 disables).")
+	members := flag.String("members", "", "write the feature weights of each sequence to this file as TSV.")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to this file.")
 	help := flag.Bool("help", false, "print this usage message.")
 
@@ -58,17 +72,46 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	t := linear.NewSeq("", nil, alphabet.DNA)
+	var a alphabet.Alphabet
+	switch strings.ToLower(*alpha) {
+	case "dna":
+		a = alphabet.DNA
+	case "protein":
+		a = alphabet.Protein
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown alphabet %q.\n", *alpha)
+		os.Exit(1)
+	}
+	if *canon && a.Len() != 4 {
+		fmt.Fprintln(os.Stderr, "Error: canonical kmers require a DNA alphabet.")
+		os.Exit(1)
+	}
+	space, err := kmerSpace(*k, a)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		os.Exit(1)
+	}
+	if space > largeKmerSpace {
+		fmt.Fprintf(os.Stderr, "Warning: %d possible kmers for k=%d; factorisation may need a large amount of memory.\n", space, *k)
+	}
+
+	t := linear.NewSeq("", nil, a)
 	if *inName == "" {
+		// Sequences are read twice, so stdin is buffered.
 		fmt.Fprintln(os.Stderr, "Reading sequences from stdin.")
-		in = fasta.NewReader(os.Stdin, t)
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.", err)
+			os.Exit(1)
+		}
+		in = bytes.NewReader(b)
 	} else if f, err := os.Open(*inName); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v.", err)
 		os.Exit(1)
 	} else {
 		defer f.Close()
 		fmt.Fprintf(os.Stderr, "Reading sequence from `%s'.\n", *inName)
-		in = fasta.NewReader(f, t)
+		in = f
 	}
 
 	if *outName == "" {
@@ -81,52 +124,76 @@ func main() {
 	}
 	defer out.Close()
 
-	totalkmers := make(map[kmerindex.Kmer]float64)
-	kmerlists := make([]map[kmerindex.Kmer]float64, 0)
-	seqTable := make([]string, 0)
-
-	for {
-		if s, err := in.Read(); err != nil {
-			break
-		} else {
-			var freqs map[kmerindex.Kmer]float64
-			if kindex, err := kmerindex.New(*k, s.(*linear.Seq)); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
-				os.Exit(1)
-			} else {
-				freqs, _ = kindex.NormalisedKmerFrequencies()
-				kmerlists = append(kmerlists, freqs)
-				for kmer, freq := range freqs {
-					totalkmers[kmer] += freq
-				}
-			}
-			seqTable = append(seqTable, string(s.Name()))
+	// The first pass counts the number of sequences containing
+	// each kmer. Only the frequencies of kmers passing the lo/hi
+	// filter are retained in the second pass.
+	seqCounts := make(map[kmerindex.Kmer]int)
+	var seqTable []string
+	p := newProgress("Counting", *every, 0)
+	err = forEachKmerFreqs(in, t, *k, *canon, func(name string, freqs map[kmerindex.Kmer]float64) {
+		for kmer := range freqs {
+			seqCounts[kmer]++
 		}
+		seqTable = append(seqTable, name)
+		p.tick()
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		os.Exit(1)
 	}
 
-	var (
-		kmerArray []float64
-		kmerTable []kmerindex.Kmer
-	)
-	for kmer, _ := range totalkmers {
-		var count int
-		for _, kmerlist := range kmerlists {
-			if kmerlist[kmer] > 0 {
-				count++
-			}
-		}
-		if count < *lo || float64(count)/float64(len(kmerlists)) > *hi {
+	// Sort the kmers so that matrix rows do not depend on map
+	// iteration order and a fixed seed gives identical factors.
+	var kmerTable []kmerindex.Kmer
+	for kmer, count := range seqCounts {
+		if count < *lo || float64(count)/float64(len(seqTable)) > *hi {
 			continue
 		}
-		row := make([]float64, len(kmerlists))
-		for i, kmerlist := range kmerlists {
-			row[i] = float64(kmerlist[kmer])
-		}
-		kmerArray = append(kmerArray, row...)
 		kmerTable = append(kmerTable, kmer)
 	}
+	if len(seqTable) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no sequences read.")
+		os.Exit(1)
+	}
+	if len(kmerTable) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no kmers passed filtering: 0 of %d kmers passed -lo/-hi; try reducing -lo (%d) or increasing -hi (%v).\n",
+			len(seqCounts), *lo, *hi)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Retained %d of %d kmers.\n", len(kmerTable), len(seqCounts))
+	sort.Slice(kmerTable, func(i, j int) bool { return kmerTable[i] < kmerTable[j] })
+	rows := make(map[kmerindex.Kmer]int, len(kmerTable))
+	for i, kmer := range kmerTable {
+		rows[kmer] = i
+	}
+	seqCounts = nil
+
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		os.Exit(1)
+	}
+	kmerArray := make([]float64, len(kmerTable)*len(seqTable))
+	var col int
+	p = newProgress("Indexing", *every, len(seqTable))
+	err = forEachKmerFreqs(in, t, *k, *canon, func(_ string, freqs map[kmerindex.Kmer]float64) {
+		for kmer, freq := range freqs {
+			if row, ok := rows[kmer]; ok {
+				kmerArray[row*len(seqTable)+col] = freq
+			}
+		}
+		col++
+		p.tick()
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		os.Exit(1)
+	}
+	if col != len(seqTable) {
+		fmt.Fprintf(os.Stderr, "Error: sequence count changed between passes: %d != %d.\n", col, len(seqTable))
+		os.Exit(1)
+	}
 
-	kMat := mat64.NewDense(len(kmerTable), len(kmerlists), kmerArray)
+	kMat := mat64.NewDense(len(kmerTable), len(seqTable), kmerArray)
 	var nonZero float64
 	f := func(_, _ int, v float64) float64 {
 		if v != 0 {
@@ -143,23 +210,362 @@ func main() {
 		*seed = time.Now().UnixNano()
 	}
 	fmt.Fprintf(os.Stderr, "Using %v as random seed.\n", *seed)
+	fmt.Fprintf(os.Stderr, "Kmer matrix hash = %016x\n", matrixHash(kMat))
 	rand.Seed(*seed)
 
+	fmt.Fprintf(os.Stderr, "Dimensions of Kmer matrix = (%v, %v)\nDensity = %.3f %%\n%v\n", r, c, (density)*100, kMat)
+
+	cfg := nmf.Config{Tolerance: *tol, MaxIter: *iter, Limit: *limit}
+	var W, H *mat64.Dense
+	if *catRange == "" {
+		W, H, _ = factorise(kMat, *cat, cfg)
+	} else {
+		var cats []int
+		if cats, err = parseRange(*catRange); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			os.Exit(1)
+		}
+		factors := make([][2]*mat64.Dense, len(cats))
+		residuals := make([]float64, len(cats))
+		for i, n := range cats {
+			fmt.Fprintf(os.Stderr, "Factorising with %d categories.\n", n)
+			factors[i][0], factors[i][1], residuals[i] = factorise(kMat, n, cfg)
+		}
+		fmt.Fprintln(os.Stderr, "cat\trelative residual")
+		for i, n := range cats {
+			fmt.Fprintf(os.Stderr, "%d\t%v\n", n, residuals[i])
+		}
+		e := elbow(residuals)
+		*cat = cats[e]
+		W, H = factors[e][0], factors[e][1]
+		fmt.Fprintf(os.Stderr, "Using %d categories at residual elbow.\n\n", *cat)
+	}
+
+	printFeature(out, kMat, W, H, seqTable, kmerTable, *k, a)
+
+	features := make([]string, *cat)
+	for i := range features {
+		features[i] = fmt.Sprintf("feature%d", i)
+	}
+	if *wOut != "" {
+		kmers := make([]string, len(kmerTable))
+		for i, kmer := range kmerTable {
+			if kmers[i], err = formatKmer(kmer, *k, a); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+				os.Exit(1)
+			}
+		}
+		if err = writeMatrix(*wOut, "kmer", W, kmers, features); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote W matrix to `%s'.\n", *wOut)
+	}
+	if *hOut != "" {
+		if err = writeMatrix(*hOut, "feature", H, features, seqTable); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote H matrix to `%s'.\n", *hOut)
+	}
+	if *members != "" {
+		if err = writeMatrix(*members, "sequence", H.T(), seqTable, features); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote feature membership to `%s'.\n", *members)
+	}
+}
+
+// writeMatrix writes m to the named file as a tab-separated table with
+// the given row and column labels. The corner cell holds the label for
+// the row label column.
+func writeMatrix(file, corner string, m mat64.Matrix, rows, cols []string) error {
+	r, c := m.Dims()
+	if r != len(rows) || c != len(cols) {
+		return fmt.Errorf("label dimension mismatch: (%d, %d) != (%d, %d)", len(rows), len(cols), r, c)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	fmt.Fprint(w, corner)
+	for _, l := range cols {
+		fmt.Fprintf(w, "\t%s", l)
+	}
+	fmt.Fprintln(w)
+	for i, l := range rows {
+		fmt.Fprint(w, l)
+		for j := 0; j < c; j++ {
+			fmt.Fprintf(w, "\t%v", m.At(i, j))
+		}
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
+
+// forEachKmerFreqs reads the fasta sequences in r using the template t
+// and calls fn with the name and kmer frequencies of each sequence. If
+// canon is true, the frequencies are folded into canonical kmers.
+func forEachKmerFreqs(r io.Reader, t *linear.Seq, k int, canon bool, fn func(name string, freqs map[kmerindex.Kmer]float64)) error {
+	in := fasta.NewReader(r, t)
+	for {
+		s, err := in.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		freqs, err := kmerFrequencies(k, s.(*linear.Seq))
+		if err != nil {
+			return err
+		}
+		if canon {
+			freqs = canonical(k, freqs)
+		}
+		fn(s.Name(), freqs)
+	}
+}
+
+// progress logs the progress of a pass over the input sequences.
+type progress struct {
+	label string
+	every int
+	total int
+	n     int
+	start time.Time
+}
+
+// newProgress returns a progress that logs every n sequences, or never
+// if every is less than one. If total is positive, an estimate of the
+// time remaining is included.
+func newProgress(label string, every, total int) *progress {
+	return &progress{label: label, every: every, total: total, start: time.Now()}
+}
+
+// tick records that a sequence has been processed.
+func (p *progress) tick() {
+	p.n++
+	if p.every < 1 || p.n%p.every != 0 {
+		return
+	}
+	elapsed := time.Since(p.start)
+	if p.total < 1 {
+		fmt.Fprintf(os.Stderr, "%s: %d sequences in %v.\n", p.label, p.n, elapsed)
+		return
+	}
+	eta := time.Duration(float64(elapsed) / float64(p.n) * float64(p.total-p.n))
+	fmt.Fprintf(os.Stderr, "%s: %d of %d sequences in %v, %v remaining.\n", p.label, p.n, p.total, elapsed, eta)
+}
+
+// canonical returns the kmer frequencies of freqs with each DNA kmer
+// and its reverse complement combined under the lesser of the two.
+// Since kmers are packed in alphabet order, this is the lexically
+// lesser kmer.
+func canonical(k int, freqs map[kmerindex.Kmer]float64) map[kmerindex.Kmer]float64 {
+	c := make(map[kmerindex.Kmer]float64, len(freqs))
+	for kmer, freq := range freqs {
+		if rc := kmerindex.ComplementOf(k, kmer); rc < kmer {
+			kmer = rc
+		}
+		c[kmer] += freq
+	}
+	return c
+}
+
+// factorise performs NMF of V into W and H with cat categories from a
+// random starting point, reporting progress to stderr. It returns the
+// factors and the relative residual of the reconstruction.
+func factorise(V *mat64.Dense, cat int, cfg nmf.Config) (W, H *mat64.Dense, relResidual float64) {
+	r, c := V.Dims()
+
 	posNorm := func(_, _ int, _ float64) float64 { return math.Abs(rand.NormFloat64()) }
 
-	Wo := mat64.NewDense(r, *cat, nil)
+	Wo := mat64.NewDense(r, cat, nil)
 	Wo.Apply(posNorm, Wo)
 
-	Ho := mat64.NewDense(*cat, c, nil)
+	Ho := mat64.NewDense(cat, c, nil)
 	Ho.Apply(posNorm, Ho)
 
-	fmt.Fprintf(os.Stderr, "Dimensions of Kmer matrix = (%v, %v)\nDensity = %.3f %%\n%v\n", r, c, (density)*100, kMat)
+	W, H, ok := nmf.Factors(V, Wo, Ho, cfg)
+
+	fmt.Fprintf(os.Stderr, "norm(H) = %v norm(W) = %v\n\nFinished = %v\n\n", mat64.Norm(H, 2), mat64.Norm(W, 2), ok)
 
-	W, H, ok := nmf.Factors(kMat, Wo, Ho, nmf.Config{Tolerance: *tol, MaxIter: *iter, Limit: *limit})
+	var residual mat64.Dense
+	residual.Mul(W, H)
+	residual.Sub(V, &residual)
+	resNorm := mat64.Norm(&residual, 2)
+	relResidual = resNorm / mat64.Norm(V, 2)
+	fmt.Fprintf(os.Stderr, "norm(V-WH) = %v relative residual = %v\n\n", resNorm, relResidual)
+
+	return W, H, relResidual
+}
 
-	fmt.Fprintf(os.Stderr, "norm(H) = %v norm(W) = %v\n\nFinished = %v\n\n", H.Norm(0), W.Norm(0), ok)
+// parseRange parses an inclusive range of positive integers in
+// the form lo-hi and returns the integers in the range.
+func parseRange(s string) ([]int, error) {
+	f := strings.Split(s, "-")
+	if len(f) != 2 {
+		return nil, fmt.Errorf("invalid range %q", s)
+	}
+	lo, err := strconv.Atoi(f[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %v", s, err)
+	}
+	hi, err := strconv.Atoi(f[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %v", s, err)
+	}
+	if lo < 1 || hi < lo {
+		return nil, fmt.Errorf("invalid range %q", s)
+	}
+	r := make([]int, 0, hi-lo+1)
+	for i := lo; i <= hi; i++ {
+		r = append(r, i)
+	}
+	return r, nil
+}
 
-	printFeature(out, kMat, W, H, seqTable, kmerTable, *k)
+// elbow returns the index of the elbow of a decreasing series of
+// residuals, taken as the point furthest from the line joining
+// the first and last points. Series with fewer than three points
+// have their last point returned.
+func elbow(residuals []float64) int {
+	n := len(residuals)
+	if n < 3 {
+		return n - 1
+	}
+	// Distances are only compared, so they are not
+	// normalised by the length of the line.
+	x1, y0, y1 := float64(n-1), residuals[0], residuals[n-1]
+	var (
+		best int
+		dist float64
+	)
+	for i, y := range residuals {
+		d := math.Abs((y1-y0)*float64(i) - x1*y + x1*y0)
+		if d > dist {
+			best, dist = i, d
+		}
+	}
+	return best
+}
+
+// matrixHash returns an FNV-1a hash of the dimensions and
+// values of m, allowing input matrices of runs to be compared.
+func matrixHash(m *mat64.Dense) uint64 {
+	h := fnv.New64a()
+	r, c := m.Dims()
+	var buf [8]byte
+	for _, v := range []int{r, c} {
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		h.Write(buf[:])
+	}
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(m.At(i, j)))
+			h.Write(buf[:])
+		}
+	}
+	return h.Sum64()
+}
+
+// largeKmerSpace is the number of possible kmers above
+// which a memory use warning is given.
+const largeKmerSpace = 1 << 24
+
+// kmerSpace returns the number of possible kmers of length k in
+// the given alphabet. It returns an error if the kmers cannot be
+// represented by a kmerindex.Kmer.
+func kmerSpace(k int, alpha alphabet.Alphabet) (uint64, error) {
+	if k < 1 {
+		return 0, fmt.Errorf("invalid kmer size: %d", k)
+	}
+	if alpha.Len() == 4 && k > kmerindex.MaxKmerLen {
+		return 0, fmt.Errorf("kmer size %d exceeds maximum of %d", k, kmerindex.MaxKmerLen)
+	}
+	const maxKmers = 1 << 32 // kmerindex.Kmer is a uint32.
+	n := uint64(1)
+	for i := 0; i < k; i++ {
+		n *= uint64(alpha.Len())
+		if n > maxKmers {
+			return 0, fmt.Errorf("kmer size %d too large for alphabet of %d letters", k, alpha.Len())
+		}
+	}
+	return n, nil
+}
+
+// kmerFrequencies returns the kmer frequencies of s normalised by
+// the length of s. Nucleotide kmers are counted using kmerindex.
+// Kmers for other alphabets are packed with one alphabet index
+// per digit and kmers including invalid letters are skipped.
+func kmerFrequencies(k int, s *linear.Seq) (map[kmerindex.Kmer]float64, error) {
+	if s.Alpha.Len() == 4 {
+		kindex, err := kmerindex.New(k, s)
+		if err != nil {
+			return nil, err
+		}
+		freqs, _ := kindex.NormalisedKmerFrequencies()
+		return freqs, nil
+	}
+
+	if k+1 > s.Len() {
+		return nil, kmerindex.ErrShortSeq
+	}
+	var (
+		base  = kmerindex.Kmer(s.Alpha.Len())
+		high  = kmerindex.Kmer(1)
+		kmer  kmerindex.Kmer
+		valid int
+	)
+	for i := 1; i < k; i++ {
+		high *= base
+	}
+	freqs := make(map[kmerindex.Kmer]float64)
+	for _, l := range s.Seq {
+		i := s.Alpha.IndexOf(l)
+		if i < 0 {
+			kmer, valid = 0, 0
+			continue
+		}
+		if valid == k {
+			kmer %= high
+		} else {
+			valid++
+		}
+		kmer = kmer*base + kmerindex.Kmer(i)
+		if valid == k {
+			freqs[kmer]++
+		}
+	}
+	l := float64(s.Len())
+	for kmer := range freqs {
+		freqs[kmer] /= l
+	}
+	return freqs, nil
+}
+
+// formatKmer returns the text representation of kmer for the given
+// alphabet and kmer length.
+func formatKmer(kmer kmerindex.Kmer, k int, alpha alphabet.Alphabet) (string, error) {
+	if alpha.Len() == 4 {
+		return kmerindex.Format(kmer, k, alpha)
+	}
+	base := kmerindex.Kmer(alpha.Len())
+	kmertext := make([]byte, k)
+	for i := k - 1; i >= 0; i, kmer = i-1, kmer/base {
+		kmertext[i] = byte(alpha.Letter(int(kmer % base)))
+	}
+	if kmer != 0 {
+		return "", kmerindex.ErrBadKmer
+	}
+	return string(kmertext), nil
 }
 
 type Weight struct {
@@ -181,7 +587,7 @@ func (self WeightList) Less(i, j int) bool {
 	return self[i].weight > self[j].weight
 }
 
-func printFeature(out io.Writer, V, W, H *mat64.Dense, seqTable []string, kmerTable []kmerindex.Kmer, k int) {
+func printFeature(out io.Writer, V, W, H *mat64.Dense, seqTable []string, kmerTable []kmerindex.Kmer, k int, alpha alphabet.Alphabet) {
 	patternCount, seqCount := H.Dims()
 	kmerCount, _ := W.Dims()
 
@@ -198,7 +604,7 @@ func printFeature(out io.Writer, V, W, H *mat64.Dense, seqTable []string, kmerTa
 		name := fmt.Sprint("[")
 		for j := 0; j < len(klist); j++ {
 			if klist[j].weight > 0 {
-				ks, err := kmerindex.Format(kmerTable[klist[j].index], k, alphabet.DNA)
+				ks, err := formatKmer(kmerTable[klist[j].index], k, alpha)
 				if err != nil {
 					panic(err)
 				}
@@ -4,16 +4,26 @@
 
 // seqer returns multiple fasta sequences corresponding to feature intervals
 // described in the JSON output from igor, converted to GFF by gffer. It will
-// also produce fastq consensus sequence output from one of MUSCLE or MAFFT.
+// also produce fastq consensus sequence output from one of MUSCLE, MAFFT or
+// Clustal Omega.
+//
+// The consensus is formed using letter qualities by default, or by simple
+// majority with -consensus majority. When consensus is written as fasta,
+// positions with a quality below -qthresh are written in lower case and
+// all other positions in upper case.
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -21,6 +31,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/biogo/biogo/alphabet"
 	"github.com/biogo/biogo/io/featio/gff"
@@ -43,26 +54,40 @@ type feat struct {
 
 var (
 	refName    string
+	indexRef   bool
 	dir        string
 	aligner    string
 	maxFam     int
 	subSample  bool
+	seed       int64
 	minFamily  int
+	minValid   int
 	lengthFrac float64
 	threads    int
 	consFasta  bool
+	keepAln    bool
+	merged     bool
+	qThresh    int
+	consMethod string
 	verbose    bool
 )
 
 func main() {
 	flag.IntVar(&maxFam, "maxFam", 0, "maxFam indicates maximum family size considered (0 == no limit).")
 	flag.BoolVar(&subSample, "subsample", false, "Choose maxFam members of a family if the family has more than maxFam members.")
+	flag.Int64Var(&seed, "seed", -1, "Seed for subsampling random number generator (-1 uses system clock).")
 	flag.IntVar(&minFamily, "famsize", 2, "Minimum number of clusters per family (must be >= 2).")
 	flag.IntVar(&threads, "threads", 1, "Number of concurrent aligner instances to run.")
 	flag.StringVar(&refName, "ref", "", "Filename of fasta file containing reference sequence.")
-	flag.StringVar(&aligner, "aligner", "", "Aligner to use to generate consensus (muscle or mafft).")
+	flag.BoolVar(&indexRef, "index", false, "Index the reference and read regions from it as needed rather than holding it in memory (reference must not be gzipped).")
+	flag.StringVar(&aligner, "aligner", "", "Aligner to use to generate consensus (muscle, mafft or clustalo).")
 	flag.BoolVar(&consFasta, "fasta", false, "Output consensus as fasta with quality case filtering.")
+	flag.BoolVar(&keepAln, "keepaln", false, "Keep the aligner output for each family as familyNNNNNN.aln.fa.")
+	flag.BoolVar(&merged, "merged", false, "Write all consensus sequences to a single consensus.fq (or consensus.fa with -fasta) in dir.")
+	flag.IntVar(&qThresh, "qthresh", 42, "Quality threshold below which fasta consensus positions are lower case.")
+	flag.StringVar(&consMethod, "consensus", "quality", "Consensus method (quality or majority).")
 	flag.Float64Var(&lengthFrac, "minLen", 0, "Minimum proportion of longest family member.")
+	flag.IntVar(&minValid, "minvalid", 0, "Minimum number of members within minLen of the longest for consensus generation (0 == no limit; 2 skips families with a single usable member).")
 	flag.StringVar(&dir, "dir", "", "Target directory for output. If not empty dir is deleted first.")
 	flag.BoolVar(&verbose, "verbose", false, "Verbosely output aligner stderr output to stderr.")
 	flag.Parse()
@@ -79,6 +104,13 @@ func main() {
 	if minFamily < 2 {
 		minFamily = 2
 	}
+	if qThresh < 0 || qThresh > math.MaxUint8 {
+		log.Fatalf("invalid quality threshold: %d", qThresh)
+	}
+	consense, ok := consensusFuncs[strings.ToLower(consMethod)]
+	if !ok {
+		log.Fatalf("invalid consensus method: %q", consMethod)
+	}
 
 	if threads < 1 {
 		threads = 1
@@ -96,7 +128,41 @@ func main() {
 		}
 	}
 
-	refStore := getReference(refName)
+	var (
+		consMu  sync.Mutex
+		consOut *os.File
+	)
+	if dir != "" && merged && aligner != "" {
+		file := "consensus.fq"
+		if consFasta {
+			file = "consensus.fa"
+		}
+		var err error
+		consOut, err = os.Create(filepath.Join(dir, file))
+		if err != nil {
+			log.Fatalf("failed to create %s: %v", file, err)
+		}
+	}
+
+	if seed == -1 {
+		seed = time.Now().UnixNano()
+	}
+	if subSample {
+		log.Printf("using %d as random seed", seed)
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	var ref reference
+	if indexRef {
+		idx, err := indexReference(refName)
+		if err != nil {
+			log.Fatalf("failed to index reference: %v", err)
+		}
+		defer idx.Close()
+		ref = idx
+	} else {
+		ref = memReference(getReference(refName))
+	}
 
 	f, err := os.Open(flag.Args()[0])
 	if err != nil {
@@ -104,7 +170,10 @@ func main() {
 	}
 	defer f.Close()
 
-	var v []*gff.Feature
+	var (
+		v        []*gff.Feature
+		manifest []*manifestRow
+	)
 	r := familyReader{r: gff.NewReader(f)}
 	for {
 		err := r.readInto(&v)
@@ -154,7 +223,7 @@ func main() {
 		if subSample {
 			// Shuffle first.
 			w := make([]*gff.Feature, 0, len(v))
-			for _, j := range rand.Perm(len(v)) {
+			for _, j := range rnd.Perm(len(v)) {
 				w = append(w, v[j])
 			}
 			v = w
@@ -168,8 +237,26 @@ func main() {
 			if sampled++; subSample && sampled > maxFam {
 				break
 			}
-			ss := *refStore[f.SeqName]
-			sequtils.Truncate(&ss, refStore[f.SeqName], f.FeatStart, f.FeatEnd)
+			n, ok := ref.length(f.SeqName)
+			if !ok {
+				log.Printf("family%06d: no reference sequence %q for member %d", fam, f.SeqName, id)
+				continue
+			}
+			if f.FeatStart < 0 || f.FeatEnd > n {
+				log.Printf("family%06d: member %d %s:%d-%d outside reference of length %d: clamping",
+					fam, id, f.SeqName, f.FeatStart, f.FeatEnd, n)
+				if f.FeatStart < 0 {
+					f.FeatStart = 0
+				}
+				if f.FeatEnd > n {
+					f.FeatEnd = n
+				}
+			}
+			ss, err := ref.region(f.SeqName, f.FeatStart, f.FeatEnd)
+			if err != nil {
+				log.Printf("failed to get sequence for %s:%d-%d: %v", f.SeqName, f.FeatStart, f.FeatEnd, err)
+				continue
+			}
 			if f.FeatStrand == seq.Minus {
 				ss.RevComp()
 			}
@@ -178,9 +265,9 @@ func main() {
 				f.SeqName, f.FeatStart, f.FeatEnd, f.FeatStrand, len(v), validLengthed, lengthFrac, f.FeatAttributes,
 			)
 			if dir == "" {
-				fmt.Printf("%60a\n", &ss)
+				fmt.Printf("%60a\n", ss)
 			} else {
-				fmt.Fprintf(out, "%60a\n", &ss)
+				fmt.Fprintf(out, "%60a\n", ss)
 			}
 		}
 		if dir == "" {
@@ -188,12 +275,20 @@ func main() {
 		} else {
 			file := out.Name()
 			out.Close()
+			row := &manifestRow{family: fam, mfa: file, members: len(v), valid: validLengthed, maxLen: maxLen}
+			manifest = append(manifest, row)
+			if validLengthed < minValid {
+				if aligner != "" {
+					log.Printf("family%06d: skipping consensus: %d members within %.2f of maximum length", fam, validLengthed, lengthFrac)
+				}
+				continue
+			}
 			fam, lv, validLengthed, lengthFrac := fam, len(v), validLengthed, lengthFrac
 			acquire()
 			go func() {
 				defer release()
 				if aligner != "" {
-					c, err := consensus(file, aligner)
+					c, err := consensus(file, aligner, consense, alphabet.Qphred(qThresh))
 					if err != nil {
 						log.Printf("failed to generate consensus for family%06d: %v", fam, err)
 					} else {
@@ -201,8 +296,17 @@ func main() {
 						c.Desc = fmt.Sprintf("(%d members - %d members within %.2f of maximum length)",
 							lv, validLengthed, lengthFrac,
 						)
-						c.Threshold = 42
-						c.QFilter = seq.CaseFilter
+						if consOut != nil {
+							consMu.Lock()
+							if consFasta {
+								fmt.Fprintf(consOut, "%60a\n", c)
+							} else {
+								fmt.Fprintf(consOut, "%q\n", c)
+							}
+							consMu.Unlock()
+							row.consensus = consOut.Name()
+							return
+						}
 						file := fmt.Sprintf("family%06d_consensus.fq", fam)
 						out, err := os.Create(filepath.Join(dir, file))
 						if err != nil {
@@ -214,6 +318,7 @@ func main() {
 								fmt.Fprintf(out, "%q\n", c)
 							}
 							out.Close()
+							row.consensus = out.Name()
 						}
 					}
 				}
@@ -221,6 +326,63 @@ func main() {
 		}
 	}
 	wait()
+
+	if consOut != nil {
+		err = consOut.Close()
+		if err != nil {
+			log.Fatalf("failed to close %s: %v", consOut.Name(), err)
+		}
+	}
+	if dir != "" {
+		err = writeManifest(filepath.Join(dir, "manifest.tsv"), manifest)
+		if err != nil {
+			log.Fatalf("failed to write manifest: %v", err)
+		}
+	}
+}
+
+// manifestRow is the manifest entry for a family written to dir.
+type manifestRow struct {
+	family int
+
+	// mfa and consensus are the paths to the
+	// family's member sequences and consensus.
+	// consensus is empty if no consensus was
+	// written.
+	mfa, consensus string
+
+	// members is the number of members in the
+	// family and valid is the number within
+	// the minimum length of the longest.
+	members, valid int
+
+	// maxLen is the length of the longest member.
+	maxLen int
+}
+
+// writeManifest writes a tab-delimited table of the output files and member
+// counts for each family in rows to the named file. Families without a
+// consensus have "." in the consensus column.
+func writeManifest(name string, rows []*manifestRow) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "family\tmfa\tconsensus\tmembers\tvalid\tmax_length")
+	for _, r := range rows {
+		cons := r.consensus
+		if cons == "" {
+			cons = "."
+		}
+		fmt.Fprintf(w, "family%06d\t%s\t%s\t%d\t%d\t%d\n", r.family, r.mfa, cons, r.members, r.valid, r.maxLen)
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 type familyReader struct {
@@ -279,6 +441,175 @@ func getReference(refName string) map[string]*linear.Seq {
 	return refStore
 }
 
+// reference is a source of reference sequence.
+type reference interface {
+	// region returns the sequence of the
+	// named reference in [start, end).
+	region(name string, start, end int) (*linear.Seq, error)
+
+	// length returns the length of the named
+	// reference and whether it exists.
+	length(name string) (int, bool)
+}
+
+// memReference is a reference held in memory.
+type memReference map[string]*linear.Seq
+
+func (r memReference) length(name string) (int, bool) {
+	s, ok := r[name]
+	if !ok {
+		return 0, false
+	}
+	return s.End(), true
+}
+
+func (r memReference) region(name string, start, end int) (*linear.Seq, error) {
+	s, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("no reference sequence %q", name)
+	}
+	ss := *s
+	err := sequtils.Truncate(&ss, s, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+// faiRecord is the location of a sequence in an indexed fasta file.
+type faiRecord struct {
+	// offset is the file offset of the
+	// first letter of the sequence.
+	offset int64
+
+	// length is the length of the sequence.
+	length int
+
+	// lineBases and lineBytes are the number
+	// of letters and bytes in each line.
+	lineBases, lineBytes int
+}
+
+// indexedReference is a reference read from a fasta file as needed.
+type indexedReference struct {
+	f     *os.File
+	index map[string]faiRecord
+}
+
+// indexReference returns an indexedReference for the named fasta file.
+// All lines of each sequence except the last must be the same length.
+func indexReference(name string) (*indexedReference, error) {
+	if filepath.Ext(name) == ".gz" {
+		return nil, fmt.Errorf("cannot index gzipped reference %q", name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &indexedReference{f: f, index: make(map[string]faiRecord)}
+
+	var (
+		b      = bufio.NewReader(f)
+		offset int64
+		id     string
+		rec    faiRecord
+		short  bool
+	)
+	for {
+		line, err := b.ReadBytes('\n')
+		if len(line) != 0 {
+			offset += int64(len(line))
+			if line[0] == '>' {
+				if id != "" {
+					r.index[id] = rec
+				}
+				id = string(bytes.TrimSpace(line[1:]))
+				if i := strings.IndexAny(id, " \t"); i >= 0 {
+					id = id[:i]
+				}
+				if _, dup := r.index[id]; dup {
+					f.Close()
+					return nil, fmt.Errorf("duplicate reference sequence %q", id)
+				}
+				rec = faiRecord{offset: offset}
+				short = false
+			} else {
+				bases := len(bytes.TrimRight(line, "\r\n"))
+				switch {
+				case id == "":
+					f.Close()
+					return nil, errors.New("sequence data before first header")
+				case bases == 0:
+					short = true
+				case short, rec.lineBases != 0 && bases > rec.lineBases:
+					f.Close()
+					return nil, fmt.Errorf("irregular line length in %q", id)
+				case rec.lineBases == 0:
+					rec.lineBases, rec.lineBytes = bases, len(line)
+				case bases < rec.lineBases:
+					short = true
+				}
+				rec.length += bases
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				f.Close()
+				return nil, err
+			}
+			break
+		}
+	}
+	if id != "" {
+		r.index[id] = rec
+	}
+
+	return r, nil
+}
+
+func (r *indexedReference) length(name string) (int, bool) {
+	rec, ok := r.index[name]
+	return rec.length, ok
+}
+
+func (r *indexedReference) region(name string, start, end int) (*linear.Seq, error) {
+	rec, ok := r.index[name]
+	if !ok {
+		return nil, fmt.Errorf("no reference sequence %q", name)
+	}
+	if start < 0 || end > rec.length || start > end {
+		return nil, errors.New("index out of range")
+	}
+
+	s := linear.NewSeq(name, nil, alphabet.DNA)
+	s.Offset = start
+	if start == end {
+		return s, nil
+	}
+	pos := func(i int) int64 {
+		return rec.offset + int64(i/rec.lineBases*rec.lineBytes+i%rec.lineBases)
+	}
+	from := pos(start)
+	buf := make([]byte, pos(end-1)+1-from)
+	_, err := r.f.ReadAt(buf, from)
+	if err != nil {
+		return nil, err
+	}
+	s.Seq = make(alphabet.Letters, 0, end-start)
+	for _, c := range buf {
+		if c != '\n' && c != '\r' {
+			s.Seq = append(s.Seq, alphabet.Letter(c))
+		}
+	}
+
+	return s, nil
+}
+
+// Close closes the underlying reference file.
+func (r *indexedReference) Close() error {
+	return r.f.Close()
+}
+
 var manager struct {
 	limit chan struct{}
 	wg    sync.WaitGroup
@@ -298,7 +629,18 @@ func wait() {
 	manager.wg.Wait()
 }
 
-func consensus(in, aligner string) (*linear.QSeq, error) {
+// consensusFuncs are the available column consensus functions.
+var consensusFuncs = map[string]seq.ConsenseFunc{
+	"quality":  seq.DefaultQConsensus,
+	"majority": seq.DefaultConsensus,
+}
+
+// consensus aligns the sequences in the file in using the specified aligner
+// and returns the consensus of the alignment formed by the cons function.
+// Positions of the consensus with quality below thresh are lower case when
+// formatted as fasta. If keepAln is true, the alignment is written next
+// to in with the extension .aln.fa.
+func consensus(in, aligner string, cons seq.ConsenseFunc, thresh alphabet.Qphred) (*linear.QSeq, error) {
 	var (
 		m   *exec.Cmd
 		err error
@@ -308,6 +650,11 @@ func consensus(in, aligner string) (*linear.QSeq, error) {
 		m, err = muscle.Muscle{InFile: in, Quiet: !verbose}.BuildCommand()
 	case "mafft":
 		m, err = mafft.Mafft{InFile: in, Auto: true, Quiet: !verbose}.BuildCommand()
+	case "clustalo":
+		// There is no biogo/external wrapper for Clustal Omega.
+		// Verbose output is not requested since clustalo writes
+		// it to stdout along with the alignment.
+		m = exec.Command("clustalo", "--infile="+in, "--outfmt=fasta")
 	default:
 		log.Fatal("no valid aligner specified")
 	}
@@ -323,13 +670,23 @@ func consensus(in, aligner string) (*linear.QSeq, error) {
 	if err != nil {
 		return nil, err
 	}
+	if keepAln {
+		aln := strings.TrimSuffix(in, filepath.Ext(in)) + ".aln.fa"
+		err = ioutil.WriteFile(aln, buf.Bytes(), 0640)
+		if err != nil {
+			log.Printf("failed to write alignment %s: %v", aln, err)
+		}
+	}
 	var (
 		r  = fasta.NewReader(buf, &linear.Seq{Annotation: seq.Annotation{Alpha: alphabet.DNA}})
-		ms = &multi.Multi{ColumnConsense: seq.DefaultQConsensus}
+		ms = &multi.Multi{ColumnConsense: cons}
 	)
 	sc := seqio.NewScanner(r)
 	for sc.Next() {
 		ms.Add(sc.Seq())
 	}
-	return ms.Consensus(true), sc.Error()
+	c := ms.Consensus(true)
+	c.Threshold = thresh
+	c.QFilter = seq.CaseFilter
+	return c, sc.Error()
 }
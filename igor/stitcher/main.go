@@ -6,10 +6,15 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"unsafe"
 
 	"github.com/biogo/biogo/seq"
@@ -47,6 +52,21 @@ func (ts *Trees) Segments() []string {
 	return s
 }
 
+// Features returns the features held by ts ordered by segment name and
+// then by start position.
+func (ts *Trees) Features() []*feat {
+	segs := ts.Segments()
+	sort.Strings(segs)
+	f := make([]*feat, 0, ts.Len())
+	for _, s := range segs {
+		ts.Do(func(e interval.IntInterface) (done bool) {
+			f = append(f, e.(*feat))
+			return
+		}, s)
+	}
+	return f
+}
+
 func (ts *Trees) Insert(i interval.IntInterface, seg string, fast bool) error {
 	t, ok := ts.Intervals[seg]
 	if !ok {
@@ -105,6 +125,13 @@ func (f *feat) Overlap(b interval.IntRange) bool { return f.End > b.Start && f.S
 func (f *feat) ID() uintptr                      { return uintptr(unsafe.Pointer(f)) }
 func (f *feat) Range() interval.IntRange         { return interval.IntRange{f.Start, f.End} }
 
+// member is a feature of the family at index fam
+// in the set of families already read.
+type member struct {
+	*feat
+	fam int
+}
+
 type strandEdge struct {
 	graph.Edge
 	Strand seq.Strand
@@ -113,13 +140,27 @@ type strandEdge struct {
 var (
 	maxFam  int
 	epsilon float64
+	minTol  int
+	maxTol  int
+	outName string
+	skipLog string
+	dotOut  string
 )
 
 func main() {
 	flag.IntVar(&maxFam, "maxFam", 0, "maxFam indicates maximum family size considered (0 == no limit).")
 	flag.Float64Var(&epsilon, "epsilon", 0.0225, "Tolerance for clustering.")
+	flag.IntVar(&minTol, "minTol", 0, "Minimum end position tolerance for clustering in bases (0 == no limit).")
+	flag.IntVar(&maxTol, "maxTol", 0, "Maximum end position tolerance for clustering in bases (0 == no limit).")
+	flag.StringVar(&outName, "out", "", "Filename for merged family JSON output.")
+	flag.StringVar(&dotOut, "dot", "", "Filename for DOT output of the family graph.")
+	flag.StringVar(&skipLog, "logskip", "", "Filename for a report of families skipped by maxFam.")
 	flag.Parse()
 
+	if minTol < 0 || maxTol < 0 || (maxTol != 0 && minTol > maxTol) {
+		fmt.Fprintf(os.Stderr, "Invalid tolerance limits: min=%d max=%d\n", minTol, maxTol)
+		os.Exit(1)
+	}
 	if len(flag.Args()) < 1 {
 		fmt.Fprintln(os.Stderr, "Need input file.")
 		os.Exit(1)
@@ -129,19 +170,53 @@ func main() {
 		os.Exit(0)
 	}
 
+	var skipped io.Writer
+	if skipLog != "" {
+		f, err := os.Create(skipLog)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		buf := bufio.NewWriter(f)
+		defer buf.Flush()
+		fmt.Fprintln(buf, "file\tline\tmembers")
+		skipped = buf
+	}
+
 	var (
 		g   = graph.NewUndirected()
 		bad int
+
+		// badAt holds the number of bad orientation
+		// connections made to each node, keyed by ID.
+		badAt = make(map[int]int)
 	)
 	{
-		var tss []*Trees
+		var (
+			tss []*Trees
+
+			// prior holds the features of all families
+			// in tss so that each feature of a family
+			// can be matched with a single query.
+			prior = &Trees{Intervals: make(map[string]*interval.IntTree)}
+			hits  []member
+		)
 		for _, n := range flag.Args() {
 			f, err := os.Open(n)
 			if err != nil {
 				fmt.Fprintf(os.Stdout, "Error: %v\n", err)
 				os.Exit(1)
 			}
-			b := bufio.NewReader(f)
+			var r io.Reader = f
+			if filepath.Ext(n) == ".gz" {
+				r, err = gzip.NewReader(f)
+				if err != nil {
+					fmt.Fprintf(os.Stdout, "Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			b := bufio.NewReader(r)
 
 			var (
 				tas []*Trees
@@ -159,6 +234,9 @@ func main() {
 					os.Exit(1)
 				}
 				if maxFam != 0 && len(v) > maxFam {
+					if skipped != nil {
+						fmt.Fprintf(skipped, "%s\t%d\t%d\n", n, j, len(v))
+					}
 					continue
 				}
 
@@ -170,33 +248,47 @@ func main() {
 				if tss != nil {
 					// Search tss for good matches with the current family...
 					for _, i := range v {
-						for k, ts := range tss {
-							ts.DoMatching(func(iv interval.IntInterface) (done bool) {
-								p := iv.(*feat)
-								if isClose(p, i, epsilon) {
-									o, ok := ori[struct{ k, j int }{k, j}]
-									if !ok {
-										ori[struct{ k, j int }{k, j}] = p.Orient * i.Orient
-									} else if o != p.Orient*i.Orient {
-										bad++
-										fmt.Fprintln(os.Stderr, "#### BAD ORIENTATION ####")
-									}
-
-									con, err := g.Connected(ts, jn)
-									if err != nil {
-										panic(err)
-									}
-									if !con {
-										g.ConnectWith(ts, jn, strandEdge{Edge: graph.NewEdge(), Strand: p.Orient * i.Orient})
-									}
-								}
-								return
-							}, i, i.Chr)
+						hits = hits[:0]
+						prior.DoMatching(func(iv interval.IntInterface) (done bool) {
+							hits = append(hits, iv.(member))
+							return
+						}, i, i.Chr)
+						// Handle matches in family order for consistent
+						// orientation conflict reporting.
+						sort.SliceStable(hits, func(a, b int) bool { return hits[a].fam < hits[b].fam })
+						for _, h := range hits {
+							k, p := h.fam, h.feat
+							if !isClose(p, i, epsilon, minTol, maxTol) {
+								continue
+							}
+							o, ok := ori[struct{ k, j int }{k, j}]
+							if !ok {
+								ori[struct{ k, j int }{k, j}] = p.Orient * i.Orient
+							} else if o != p.Orient*i.Orient {
+								bad++
+								badAt[jn.ID()]++
+								fmt.Fprintln(os.Stderr, "#### BAD ORIENTATION ####")
+							}
+
+							ts := tss[k]
+							con, err := g.Connected(ts, jn)
+							if err != nil {
+								panic(err)
+							}
+							if !con {
+								g.ConnectWith(ts, jn, strandEdge{Edge: graph.NewEdge(), Strand: p.Orient * i.Orient})
+							}
 						}
 					}
 				}
 			}
 			f.Close()
+			for k, ta := range tas {
+				for _, i := range ta.Features() {
+					prior.Insert(member{feat: i, fam: len(tss) + k}, i.Chr, true)
+				}
+			}
+			prior.AdjustRanges()
 			if tss == nil {
 				tss = tas
 			} else {
@@ -205,13 +297,37 @@ func main() {
 		}
 	}
 
+	var enc *json.Encoder
+	if outName != "" {
+		f, err := os.Create(outName)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		buf := bufio.NewWriter(f)
+		defer buf.Flush()
+		enc = json.NewEncoder(buf)
+	}
+
+	contra := contradictions(g)
 	cc := graph.ConnectedComponents(g, graph.EdgeFilter(func(e graph.Edge) bool {
-		// We need to correct orientation here.
-		return true
+		return !contra[e.ID()]
 	}))
-	fmt.Printf("Bad orientation connections: %d G=%v Connected components: %d\n", bad, g, len(cc))
+	if dotOut != "" {
+		err := writeDOT(dotOut, g, contra, badAt)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Bad orientation connections: %d Contradictory edges excluded: %d G=%v Connected components: %d\n", bad, len(contra), g, len(cc))
 
 	for i, c := range cc {
+		var cbad int
+		for _, n := range c {
+			cbad += badAt[n.ID()]
+		}
 		ts := c[0].(*Trees)
 		for j, fi := range c[1:] {
 			cfi := fi.(*Trees)
@@ -232,10 +348,91 @@ func main() {
 			c[j+1] = nil
 		}
 		cc[i] = cc[i][:1]
-		fmt.Printf("Component %d: %d\n", i, ts.Len())
+		fmt.Printf("Component %d: %d (bad orientation connections: %d)\n", i, ts.Len(), cbad)
+
+		if enc != nil {
+			err := enc.Encode(ts.Features())
+			if err != nil {
+				fmt.Fprintf(os.Stdout, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
 	}
 }
 
+// contradictions returns the IDs of edges in g whose strand contradicts
+// the relative orientation of the families they join. The orientation of
+// each family is propagated from an arbitrary family of each connected
+// component by breadth first traversal, so the edges reported depend on
+// the order of traversal.
+func contradictions(g *graph.Undirected) map[int]bool {
+	var (
+		orient = make(map[int]seq.Strand)
+		contra = make(map[int]bool)
+		queue  []graph.Node
+	)
+	for _, n := range g.Nodes() {
+		if _, ok := orient[n.ID()]; ok {
+			continue
+		}
+		orient[n.ID()] = seq.Plus
+		queue = append(queue[:0], n)
+		for len(queue) > 0 {
+			u := queue[0]
+			queue = queue[1:]
+			for _, h := range u.Hops(nil) {
+				s := h.Edge.(strandEdge).Strand
+				if s == seq.None {
+					continue
+				}
+				want := orient[u.ID()] * s
+				o, ok := orient[h.Node.ID()]
+				switch {
+				case !ok:
+					orient[h.Node.ID()] = want
+					queue = append(queue, h.Node)
+				case o != want:
+					contra[h.Edge.ID()] = true
+				}
+			}
+		}
+	}
+	return contra
+}
+
+// writeDOT writes the family graph g to the named file in DOT format.
+// Nodes are labelled with the family ID and member count and are red
+// if bad orientation connections were made to them. Edges are labelled
+// with their strand and edges in contra are dashed and red.
+func writeDOT(file string, g *graph.Undirected, contra map[int]bool, badAt map[int]int) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintln(w, "graph families {")
+	for _, n := range g.Nodes() {
+		fmt.Fprintf(w, "  %d [label=\"%[1]d (%d)\"", n.ID(), n.(*Trees).Len())
+		if badAt[n.ID()] != 0 {
+			fmt.Fprint(w, " color=red")
+		}
+		fmt.Fprintln(w, "];")
+	}
+	for _, e := range g.Edges() {
+		u, v := e.Nodes()
+		fmt.Fprintf(w, "  %d -- %d [label=\"%v\"", u.ID(), v.ID(), e.(strandEdge).Strand)
+		if contra[e.ID()] {
+			fmt.Fprint(w, " style=dashed color=red")
+		}
+		fmt.Fprintln(w, "];")
+	}
+	fmt.Fprintln(w, "}")
+
+	return w.Flush()
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -250,10 +447,19 @@ func max(a, b int) int {
 	return b
 }
 
-func isClose(a, b *feat, thresh float64) bool {
+// isClose returns whether the ends of a and b are within a distance
+// scaled by thresh and the span of the pair. If minTol or maxTol are
+// non-zero, the distance is clamped to be within them.
+func isClose(a, b *feat, thresh float64, minTol, maxTol int) bool {
 	s, e := min(a.Start, b.Start), max(a.End, b.End)
 	l := float64(e-s) / 4
 	cut := thresh * l * l
+	if minTol != 0 {
+		cut = math.Max(cut, float64(minTol)*float64(minTol))
+	}
+	if maxTol != 0 {
+		cut = math.Min(cut, float64(maxTol)*float64(maxTol))
+	}
 	ds, de := float64(a.Start-b.Start), float64(a.End-b.End)
 	return ds*ds+de*de < cut
 }
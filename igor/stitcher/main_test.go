@@ -0,0 +1,43 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestIsClose(c *check.C) {
+	const thresh = 0.0225
+	for i, t := range []struct {
+		a, b           feat
+		minTol, maxTol int
+		close          bool
+	}{
+		// 100bp features have a tolerance of 3.75bp.
+		{a: feat{Start: 0, End: 100}, b: feat{Start: 2, End: 100}, close: true},
+		{a: feat{Start: 0, End: 100}, b: feat{Start: 5, End: 100}, close: false},
+		{a: feat{Start: 0, End: 100}, b: feat{Start: 5, End: 100}, minTol: 10, close: true},
+		{a: feat{Start: 0, End: 100}, b: feat{Start: 5, End: 100}, minTol: 10, maxTol: 20, close: true},
+		{a: feat{Start: 0, End: 100}, b: feat{Start: 2, End: 100}, maxTol: 1, close: false},
+
+		// 100kb features have a tolerance of 3750bp.
+		{a: feat{Start: 0, End: 100000}, b: feat{Start: 2000, End: 100000}, close: true},
+		{a: feat{Start: 0, End: 100000}, b: feat{Start: 2000, End: 100000}, maxTol: 1000, close: false},
+		{a: feat{Start: 0, End: 100000}, b: feat{Start: 500, End: 100000}, maxTol: 1000, close: true},
+		{a: feat{Start: 0, End: 100000}, b: feat{Start: 2000, End: 100000}, minTol: 10, close: true},
+		{a: feat{Start: 0, End: 100000}, b: feat{Start: 5000, End: 100000}, minTol: 10, close: false},
+	} {
+		c.Check(isClose(&t.a, &t.b, thresh, t.minTol, t.maxTol), check.Equals, t.close, check.Commentf("Test %d", i))
+		c.Check(isClose(&t.b, &t.a, thresh, t.minTol, t.maxTol), check.Equals, t.close, check.Commentf("Test %d reversed", i))
+	}
+}
@@ -1,41 +1,99 @@
 // pwmscan performs a position weight matrix scan of a set of sequences to
-// search for a motif.
+// search for a motif. Several matrices may be given to -mat, either as a
+// comma-separated list of files or as directories of matrix files; each
+// sequence is scanned against every matrix and hits are tagged with the
+// name of the matrix file.
+//
+// With -both, DNA sequences are also scanned on the reverse strand. Hits on
+// the reverse strand are reported in forward strand coordinates with a minus
+// strand, and the reported motif sequence is the reverse complement of the
+// forward strand so that it reads in the orientation of the matrix.
+//
+// Output is written per sequence and is gzip compressed if the -out file
+// name ends in ".gz".
+//
+// When the matrix is derived from an alignment, a pseudocount (-pseudo,
+// default 0.25) is added to each cell of the column counts before each
+// column is normalized to frequencies. This prevents bases that are not
+// observed in a column from contributing a zero weight that would exclude
+// otherwise good matches; larger values flatten the matrix towards the
+// uniform distribution.
 package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/feat"
 	"github.com/biogo/biogo/io/featio/gff"
 	"github.com/biogo/biogo/io/seqio/fasta"
 	"github.com/biogo/biogo/pwm"
 	"github.com/biogo/biogo/seq"
 	"github.com/biogo/biogo/seq/linear"
 	"github.com/biogo/biogo/seq/multi"
+	"github.com/biogo/biogo/seq/sequtils"
 )
 
+// aminoAcids is the alphabet of the twenty standard amino acids used for
+// protein matrix columns. Unlike alphabet.Protein, the letter indices of
+// aminoAcids map directly onto matrix columns.
+var aminoAcids = alphabet.Must(alphabet.NewAlphabet(
+	"acdefghiklmnpqrstvwy",
+	feat.Protein,
+	'-', 'x',
+	!alphabet.CaseSensitive,
+))
+
+// motif is a named position weight matrix. If wm is nil, searches are
+// performed using the normalized matrix.
+type motif struct {
+	name     string
+	wm       *pwm.PWM
+	matrix   [][]float64
+	minScore float64
+	hits     int
+}
+
+// search returns the hits of m in s scoring at least m.minScore.
+func (m *motif) search(s *linear.Seq) []feat.Feature {
+	if m.wm != nil {
+		return m.wm.Search(s, s.Start(), s.End(), m.minScore)
+	}
+	return search(m.matrix, s, m.minScore)
+}
+
 func main() {
 	var (
-		in, min *fasta.Reader
-		mf      *os.File
-		matin   *bufio.Reader
-		align   *multi.Multi
-		out     *gff.Writer
-		err     error
+		in  *fasta.Reader
+		out *gff.Writer
+		err error
 	)
 
 	inName := flag.String("in", "", "Filename for input. Defaults to stdin.")
-	matName := flag.String("mat", "", "Filename for matrix/alignment input.")
+	matName := flag.String("mat", "", "Comma-separated list of matrix/alignment files or directories of them.")
 	num := flag.Bool("num", false, "Use numerical description rather than sequence.")
 	outName := flag.String("out", "", "Filename for output. Defaults to stdout.")
 	precision := flag.Int("prec", 6, "Precision for floating point output.")
-	minScore := flag.Float64("score", 0.9, "Minimum score for a hit.")
+	minScore := flag.Float64("score", 0.9, "Minimum score for a hit as a fraction of the maximum score.")
+	pValue := flag.Float64("pvalue", 0, "P-value threshold for a hit. Overrides -score when non-zero.")
+	bgFreqs := flag.String("bg", "", "Comma-separated background letter frequencies for -pvalue in matrix column order. Defaults to uniform.")
+	alpha := flag.String("alpha", "dna", "Sequence and matrix alphabet (dna or protein).")
+	both := flag.Bool("both", false, "Scan both strands of DNA sequences.")
+	minGap := flag.Int("mingap", 0, "Minimum distance between the starts of reported hits. Zero reports all hits.")
+	summaryName := flag.String("summary", "", "Filename for a tab-separated table of per-sequence hit counts.")
+	bed := flag.Bool("bed", false, "Write hits as BED6 rather than GFF.")
+	pseudo := flag.Float64("pseudo", 0.25, "Pseudocount added to each cell of an alignment-derived matrix.")
 	help := flag.Bool("help", false, "Print this usage message.")
 
 	flag.Parse()
@@ -49,70 +107,95 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
-
-	matrix := [][]float64{}
-	if *num {
-		if mf, err = os.Open(*matName); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
-			os.Exit(1)
+	if *pseudo < 0 {
+		fmt.Fprintln(os.Stderr, "Error: pseudocount must not be negative.")
+		os.Exit(1)
+	}
+	if *pValue < 0 || *pValue > 1 {
+		fmt.Fprintln(os.Stderr, "Error: p-value must be in [0, 1].")
+		os.Exit(1)
+	}
+	var alphabetType alphabet.Alphabet
+	switch strings.ToLower(*alpha) {
+	case "dna":
+		alphabetType = alphabet.DNA
+	case "protein":
+		alphabetType = aminoAcids
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown alphabet %q.\n", *alpha)
+		os.Exit(1)
+	}
+	if *minGap < 0 {
+		fmt.Fprintln(os.Stderr, "Error: minimum gap must not be negative.")
+		os.Exit(1)
+	}
+	if *both && alphabetType != alphabet.DNA {
+		fmt.Fprintln(os.Stderr, "Error: both strand scanning requires a DNA alphabet.")
+		os.Exit(1)
+	}
+	var bg []float64
+	if *pValue != 0 {
+		if *bgFreqs == "" {
+			bg = make([]float64, alphabetType.Len())
+			for i := range bg {
+				bg[i] = 1 / float64(len(bg))
+			}
 		} else {
-			matin = bufio.NewReader(mf)
-		}
-		defer mf.Close()
-
-		for {
-			line, err := matin.ReadBytes('\n')
+			bg, err = parseBackground(*bgFreqs)
 			if err != nil {
-				break
-			}
-			if line[len(line)-1] == '\n' {
-				line = line[:len(line)-1]
-			}
-			fields := strings.Split(string(line), "\t")
-			if len(fields) < 4 {
-				break
+				fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+				os.Exit(1)
 			}
-			matrix = append(matrix, make([]float64, 0, 4))
-			for _, s := range fields {
-				if f, err := strconv.ParseFloat(s, 64); err != nil {
-					fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
-					os.Exit(1)
-				} else {
-					matrix[len(matrix)-1] = append(matrix[len(matrix)-1], f)
-				}
+			if len(bg) != alphabetType.Len() {
+				fmt.Fprintf(os.Stderr, "Error: %d background frequencies given for %d letter alphabet.\n", len(bg), alphabetType.Len())
+				os.Exit(1)
 			}
 		}
-	} else {
-		mr, err := os.Open(*matName)
+	}
+
+	paths, err := matrixFiles(*matName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		os.Exit(1)
+	}
+	var motifs []*motif
+	for _, path := range paths {
+		var matrix [][]float64
+		if *num {
+			matrix, err = readNumMatrix(path, alphabetType.Len())
+		} else {
+			matrix, err = readAlignMatrix(path, alphabetType, *pseudo)
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			fmt.Fprintf(os.Stderr, "Error: %s: %v.\n", path, err)
 			os.Exit(1)
 		}
-		min = fasta.NewReader(mr, linear.NewSeq("", nil, alphabet.DNA))
-		for {
-			s, err := min.Read()
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		min := *minScore
+		if *pValue != 0 {
+			min, err = scoreThreshold(matrix, bg, *pValue)
 			if err != nil {
-				if err != io.EOF {
-					fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
-					os.Exit(1)
-				}
-				break
+				fmt.Fprintf(os.Stderr, "Error: %s: %v.\n", path, err)
+				os.Exit(1)
 			}
-			align.Add(s)
+			fmt.Fprintf(os.Stderr, "Using score threshold %.3f for %s.\n", min, name)
 		}
-		mr.Close()
-
-		for i := 0; i < align.Len(); i++ {
-			matrix[i] = make([]float64, 4)
-			for _, v := range align.Column(i, true) {
-				if base := alphabet.DNA.IndexOf(v); base >= 0 {
-					matrix[i][base]++
-				}
+		mot := &motif{name: name, minScore: min}
+		if alphabetType == alphabet.DNA {
+			mot.wm = pwm.New(matrix)
+			mot.wm.Format = fmt.Sprintf("%%.%de", *precision)
+		} else {
+			// The pwm package calculates hit probabilities
+			// assuming a four letter alphabet, so other
+			// alphabets are searched by score alone.
+			mot.matrix, err = normalize(matrix)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v.\n", path, err)
+				os.Exit(1)
 			}
 		}
+		motifs = append(motifs, mot)
 	}
-	wm := pwm.New(matrix)
-	wm.Format = fmt.Sprintf("%%.%de", *precision)
 
 	var r io.ReadCloser
 	if *inName == "" {
@@ -123,24 +206,51 @@ func main() {
 	} else {
 		defer r.Close()
 	}
-	in = fasta.NewReader(r, linear.NewSeq("", nil, alphabet.DNA))
-
-	if *matName == "" {
-		flag.Usage()
-		os.Exit(1)
-	}
+	in = fasta.NewReader(r, linear.NewSeq("", nil, alphabetType))
 
+	var (
+		w   io.Writer
+		buf *bufio.Writer
+	)
 	if *outName == "" {
-		out = gff.NewWriter(os.Stdout, 60, true)
+		w = os.Stdout
 	} else if f, err := os.Create(*outName); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		os.Exit(1)
 	} else {
 		defer f.Close()
-		buf := bufio.NewWriter(f)
+		if filepath.Ext(*outName) == ".gz" {
+			gz := gzip.NewWriter(f)
+			defer gz.Close()
+			buf = bufio.NewWriter(gz)
+		} else {
+			buf = bufio.NewWriter(f)
+		}
 		defer buf.Flush()
-		out = gff.NewWriter(buf, 60, true)
+		w = buf
+	}
+	if !*bed {
+		out = gff.NewWriter(w, 60, true)
+		out.Precision = 2
+	}
+
+	var summary *bufio.Writer
+	if *summaryName != "" {
+		f, err := os.Create(*summaryName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		summary = bufio.NewWriter(f)
+		defer summary.Flush()
+		fmt.Fprint(summary, "#seq\tlength")
+		for _, mot := range motifs {
+			fmt.Fprintf(summary, "\t%s", mot.name)
+		}
+		fmt.Fprintln(summary)
 	}
-	out.Precision = 2
+	counts := make([]int, len(motifs))
 
 	for {
 		if s, err := in.Read(); err != nil {
@@ -148,38 +258,443 @@ func main() {
 		} else {
 			fmt.Fprintf(os.Stderr, "Working on: %s %s\n", s.Name(), s.Description())
 
-			res := wm.Search(s.(*linear.Seq), s.Start(), s.End(), *minScore)
-			if len(res) == 1 {
-				fmt.Fprintf(os.Stderr, "... found %d match.\n", len(res))
-			} else {
-				fmt.Fprintf(os.Stderr, "... found %d matches.\n", len(res))
-			}
-			if len(res) > 0 {
-				out.WriteMetaData(gff.Sequence{s.Name(), s.Alphabet().Moltype()})
-			}
-			for _, r := range res {
-				m := r.(*pwm.Feature)
-				out.Write(&gff.Feature{
-					SeqName:    s.Name(),
-					Source:     "pwmscan",
-					Feature:    "match",
-					FeatStart:  m.MotifStart,
-					FeatEnd:    m.MotifEnd,
-					FeatScore:  &m.MotifScore,
-					FeatStrand: seq.Strand(m.MotifOrient),
-					FeatFrame:  gff.NoFrame,
-					FeatAttributes: gff.Attributes{
+			ls := s.(*linear.Seq)
+			var rc *linear.Seq
+			if *both {
+				rc = ls.Clone().(*linear.Seq)
+				rc.RevComp()
+			}
+
+			var wroteMeta bool
+			for i, mot := range motifs {
+				res := mot.search(ls)
+				if rc != nil {
+					for _, r := range mot.search(rc) {
+						res = append(res, toForward(r.(*pwm.Feature), ls))
+					}
+					sort.Sort(byStart(res))
+				}
+				if *minGap > 0 {
+					res = collapse(res, *minGap)
+				}
+				counts[i] = len(res)
+				mot.hits += len(res)
+				if len(res) == 1 {
+					fmt.Fprintf(os.Stderr, "... found %d match to %s.\n", len(res), mot.name)
+				} else {
+					fmt.Fprintf(os.Stderr, "... found %d matches to %s.\n", len(res), mot.name)
+				}
+				if *bed {
+					for _, r := range res {
+						err = writeBED(w, s.Name(), mot.name, r.(*pwm.Feature))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+							os.Exit(1)
+						}
+					}
+					continue
+				}
+				if len(res) > 0 && !wroteMeta {
+					out.WriteMetaData(gff.Sequence{s.Name(), s.Alphabet().Moltype()})
+					wroteMeta = true
+				}
+				for _, r := range res {
+					m := r.(*pwm.Feature)
+					attrs := gff.Attributes{
+						gff.Attribute{
+							Tag:   "Matrix",
+							Value: mot.name,
+						},
 						gff.Attribute{
 							Tag:   "Motif",
 							Value: fmt.Sprintf("%-v", m.MotifSeq),
 						},
-						gff.Attribute{
+					}
+					if !math.IsNaN(m.MotifProb) {
+						attrs = append(attrs, gff.Attribute{
 							Tag:   "p",
 							Value: fmt.Sprintf("%.*f", *precision, m.MotifProb),
-						},
-					},
-				})
+						})
+					}
+					out.Write(&gff.Feature{
+						SeqName:        s.Name(),
+						Source:         "pwmscan",
+						Feature:        "match",
+						FeatStart:      m.MotifStart,
+						FeatEnd:        m.MotifEnd,
+						FeatScore:      &m.MotifScore,
+						FeatStrand:     seq.Strand(m.MotifOrient),
+						FeatFrame:      gff.NoFrame,
+						FeatAttributes: attrs,
+					})
+				}
+			}
+
+			if summary != nil {
+				fmt.Fprintf(summary, "%s\t%d", s.Name(), s.Len())
+				for _, c := range counts {
+					fmt.Fprintf(summary, "\t%d", c)
+				}
+				fmt.Fprintln(summary)
+			}
+
+			// Flush completed sequences so partial output is usable.
+			if buf != nil {
+				if err = buf.Flush(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+					os.Exit(1)
+				}
 			}
 		}
 	}
+
+	for _, mot := range motifs {
+		fmt.Fprintf(os.Stderr, "%s: %d hits.\n", mot.name, mot.hits)
+	}
+}
+
+// matrixFiles returns the matrix file paths specified by the comma-separated
+// list spec. Directories in the list are expanded to the regular files they
+// contain, in lexical order.
+func matrixFiles(spec string) ([]string, error) {
+	var paths []string
+	for _, name := range strings.Split(spec, ",") {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, name)
+			continue
+		}
+		ents, err := ioutil.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			if e.Mode().IsRegular() {
+				paths = append(paths, filepath.Join(name, e.Name()))
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no matrix files in %q", spec)
+	}
+	return paths, nil
+}
+
+// readNumMatrix reads a tab-separated numerical matrix with cols columns
+// from the named file. Blank lines are ignored. Every other line must hold
+// exactly cols values.
+func readNumMatrix(name string, cols int) ([][]float64, error) {
+	mf, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+
+	var matrix [][]float64
+	sc := bufio.NewScanner(mf)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != cols {
+			return nil, fmt.Errorf("line %d: row has %d fields, expected %d", line, len(fields), cols)
+		}
+		row := make([]float64, len(fields))
+		for i, s := range fields {
+			row[i], err = strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		matrix = append(matrix, row)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(matrix) == 0 {
+		return nil, fmt.Errorf("no matrix rows")
+	}
+	return matrix, nil
+}
+
+// readAlignMatrix reads a FASTA alignment of the given alphabet from the
+// named file and returns the column letter frequencies after adding pseudo
+// to each cell.
+func readAlignMatrix(name string, alpha alphabet.Alphabet, pseudo float64) ([][]float64, error) {
+	mr, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	min := fasta.NewReader(mr, linear.NewSeq("", nil, alpha))
+	align, err := multi.NewMulti("", nil, seq.DefaultConsensus)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		s, err := min.Read()
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+		align.Add(s)
+	}
+
+	matrix := make([][]float64, align.Len())
+	for i := range matrix {
+		matrix[i] = make([]float64, alpha.Len())
+		for j := range matrix[i] {
+			matrix[i][j] = pseudo
+		}
+		for _, v := range align.Column(i, true) {
+			if base := alpha.IndexOf(v); base >= 0 {
+				matrix[i][base]++
+			}
+		}
+
+		// Normalize the column to base frequencies.
+		var sum float64
+		for _, c := range matrix[i] {
+			sum += c
+		}
+		if sum == 0 {
+			return nil, fmt.Errorf("no valid bases in alignment column %d", i)
+		}
+		for j := range matrix[i] {
+			matrix[i][j] /= sum
+		}
+	}
+	return matrix, nil
+}
+
+// scoreResolution is the number of discrete score steps used to
+// represent the range of scores when computing a score distribution.
+const scoreResolution = 1000
+
+// parseBackground parses a comma-separated list of background letter
+// frequencies, normalizing them to sum to one.
+func parseBackground(s string) ([]float64, error) {
+	fields := strings.Split(s, ",")
+	bg := make([]float64, len(fields))
+	var sum float64
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0 {
+			return nil, fmt.Errorf("negative background frequency: %v", v)
+		}
+		bg[i] = v
+		sum += v
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("background frequencies sum to zero")
+	}
+	for i := range bg {
+		bg[i] /= sum
+	}
+	return bg, nil
+}
+
+// scoreThreshold returns the minimum score, as a fraction of the maximum
+// achievable score for matrix, that is attained by a random sequence drawn
+// from the background distribution bg with probability no greater than p.
+// The score distribution is calculated by dynamic programming over the
+// matrix rows with scores discretized into scoreResolution steps.
+func scoreThreshold(matrix [][]float64, bg []float64, p float64) (float64, error) {
+	var maxScore float64
+	for i, row := range matrix {
+		if len(row) != len(bg) {
+			return 0, fmt.Errorf("matrix row %d has %d columns but background has %d", i, len(row), len(bg))
+		}
+		var max float64
+		for _, v := range row {
+			if v < 0 {
+				return 0, fmt.Errorf("negative matrix value in row %d", i)
+			}
+			if v > max {
+				max = v
+			}
+		}
+		maxScore += max
+	}
+	if maxScore == 0 {
+		return 0, fmt.Errorf("matrix has no positive values")
+	}
+
+	// dist[k] holds the probability of a discretized score of k
+	// for the rows considered so far.
+	dist := []float64{1}
+	for _, row := range matrix {
+		steps := make([]int, len(row))
+		top := 0
+		for j, v := range row {
+			steps[j] = int(math.Floor(v/maxScore*scoreResolution + 0.5))
+			if steps[j] > top {
+				top = steps[j]
+			}
+		}
+		next := make([]float64, len(dist)+top)
+		for k, pk := range dist {
+			if pk == 0 {
+				continue
+			}
+			for j, st := range steps {
+				next[k+st] += pk * bg[j]
+			}
+		}
+		dist = next
+	}
+
+	// Find the lowest score whose upper tail probability is within p.
+	var tail float64
+	k := len(dist)
+	for k > 0 && tail+dist[k-1] <= p {
+		k--
+		tail += dist[k]
+	}
+	return float64(k) / float64(len(dist)-1), nil
+}
+
+// normalize returns a copy of matrix scaled so that the maximum achievable
+// score is one, as is done by pwm.New.
+func normalize(matrix [][]float64) ([][]float64, error) {
+	var maxScore float64
+	for _, row := range matrix {
+		var max float64
+		for _, v := range row {
+			if v > max {
+				max = v
+			}
+		}
+		maxScore += max
+	}
+	if maxScore == 0 {
+		return nil, fmt.Errorf("matrix has no positive values")
+	}
+	norm := make([][]float64, len(matrix))
+	for i, row := range matrix {
+		norm[i] = make([]float64, len(row))
+		for j, v := range row {
+			norm[i][j] = v / maxScore
+		}
+	}
+	return norm, nil
+}
+
+// search performs a scan of s using the normalized matrix, returning
+// features for positions scoring at least minScore. Windows containing
+// letters outside the alphabet are skipped. Hit probabilities are not
+// calculated and are reported as NaN.
+func search(matrix [][]float64, s *linear.Seq, minScore float64) []feat.Feature {
+	var (
+		index  = s.Alphabet().LetterIndex()
+		length = len(matrix)
+
+		f []feat.Feature
+	)
+LOOP:
+	for pos := s.Start(); pos+length <= s.End(); pos++ {
+		var score float64
+		for i := 0; i < length; i++ {
+			l := index[s.At(pos+i).L]
+			if l < 0 {
+				continue LOOP
+			}
+			score += matrix[i][l]
+		}
+		if score < minScore {
+			continue
+		}
+
+		mot := s.New()
+		sequtils.Truncate(mot, s, pos, pos+length)
+		f = append(f, &pwm.Feature{
+			MotifLocation: s,
+			MotifStart:    pos,
+			MotifEnd:      pos + length,
+			MotifScore:    score,
+			MotifProb:     math.NaN(),
+			MotifSeq:      mot,
+			MotifOrient:   s.Orientation(),
+			Moltype:       s.Moltype(),
+		})
+	}
+	return f
+}
+
+// toForward converts the coordinates of m, found on the reverse complement
+// of s, to the coordinates of s. The motif sequence of m is left in the
+// orientation of the motif, so that it matches the matrix, and m retains
+// the reverse orientation of the strand it was found on.
+func toForward(m *pwm.Feature, s *linear.Seq) *pwm.Feature {
+	m.MotifStart, m.MotifEnd = s.Start()+s.End()-m.MotifEnd, s.Start()+s.End()-m.MotifStart
+	m.MotifLocation = s
+	return m
+}
+
+// byStart sorts features by start position.
+type byStart []feat.Feature
+
+func (f byStart) Len() int           { return len(f) }
+func (f byStart) Less(i, j int) bool { return f[i].Start() < f[j].Start() }
+func (f byStart) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// collapse returns the highest scoring hits in res such that no two
+// returned hits start within gap of each other. The returned hits are
+// sorted by start position.
+func collapse(res []feat.Feature, gap int) []feat.Feature {
+	byScore := make([]feat.Feature, len(res))
+	copy(byScore, res)
+	sort.SliceStable(byScore, func(i, j int) bool {
+		return byScore[i].(*pwm.Feature).MotifScore > byScore[j].(*pwm.Feature).MotifScore
+	})
+
+	var (
+		kept   []feat.Feature
+		starts []int // Sorted starts of kept hits.
+	)
+	for _, f := range byScore {
+		i := sort.SearchInts(starts, f.Start())
+		if i < len(starts) && starts[i]-f.Start() < gap {
+			continue
+		}
+		if i > 0 && f.Start()-starts[i-1] < gap {
+			continue
+		}
+		starts = append(starts, 0)
+		copy(starts[i+1:], starts[i:])
+		starts[i] = f.Start()
+		kept = append(kept, f)
+	}
+	sort.Sort(byStart(kept))
+	return kept
+}
+
+// writeBED writes a BED6 line for the motif hit m in the sequence chrom.
+// pwm.Feature positions are 0-based half-open, so they are used directly
+// as BED coordinates.
+func writeBED(w io.Writer, chrom, name string, m *pwm.Feature) error {
+	strand := "."
+	switch m.MotifOrient {
+	case feat.Forward:
+		strand = "+"
+	case feat.Reverse:
+		strand = "-"
+	}
+	_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%.2f\t%s\n",
+		chrom, m.MotifStart, m.MotifEnd, name, m.MotifScore, strand)
+	return err
 }
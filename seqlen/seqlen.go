@@ -3,7 +3,17 @@
 // license that can be found in the LICENSE file.
 
 // seqlen filters sequences that are above a length
-// cut-off.
+// cut-off, and optionally below an upper length bound.
+// The bounds are exclusive unless -inclusive is given.
+// Sequences may also be filtered by their G+C fraction,
+// calculated over unambiguous bases, and by the fraction
+// of the sequence that is N.
+// With -v, the selection is inverted so that sequences
+// failing the filter are kept. Sequences that are not
+// kept are discarded unless -rejected is given, in which
+// case they are written to that file. The numbers of
+// sequences kept and filtered are reported when all
+// sequences have been read.
 package main
 
 import (
@@ -18,10 +28,17 @@ import (
 )
 
 var (
-	inf  = flag.String("in", "", "input contig file name to be fragmented. Defaults to stdin.")
-	outf = flag.String("out", "", "output file name. Defaults to stdout")
-	min  = flag.Int("min", 2500, "minimum sequence length cut-off (bp)")
-	help = flag.Bool("help", false, "help prints this message.")
+	inf   = flag.String("in", "", "input contig file name to be fragmented. Defaults to stdin.")
+	outf  = flag.String("out", "", "output file name. Defaults to stdout")
+	min   = flag.Int("min", 2500, "minimum sequence length cut-off (bp)")
+	max   = flag.Int("maxLen", 0, "maximum sequence length cut-off (bp), no upper bound if zero")
+	minGC = flag.Float64("minGC", 0, "minimum G+C fraction")
+	maxGC = flag.Float64("maxGC", 1, "maximum G+C fraction")
+	maxN  = flag.Float64("maxN", 1, "maximum N fraction")
+	inv   = flag.Bool("v", false, "invert the selection, keeping sequences that fail the filter")
+	rejf  = flag.String("rejected", "", "output file name for sequences that are not kept")
+	incl  = flag.Bool("inclusive", false, "keep sequences with lengths equal to the cut-offs")
+	help  = flag.Bool("help", false, "help prints this message.")
 )
 
 func main() {
@@ -30,6 +47,9 @@ func main() {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *max != 0 && *max < *min {
+		log.Fatalf("maximum length %d is less than minimum length %d", *max, *min)
+	}
 
 	var in *os.File
 	var err error
@@ -53,18 +73,67 @@ func main() {
 	defer out.Close()
 
 	w := fasta.NewWriter(out, 60)
+	var rej *fasta.Writer
+	if *rejf != "" {
+		f, err := os.Create(*rejf)
+		if err != nil {
+			log.Fatalf("failed to open %q: %v", *rejf, err)
+		}
+		defer f.Close()
+		rej = fasta.NewWriter(f, 60)
+	}
 	sc := seqio.NewScanner(r)
+	var kept, filtered int
 	for sc.Next() {
 		s := sc.Seq()
-		if s.Len() > *min {
-			_, err := w.Write(s)
-			if err != nil {
-				log.Fatalf("failed to write sequence %q: %v", s.Name(), err)
+		if keep(s.(*linear.Seq)) == *inv {
+			filtered++
+			if rej != nil {
+				_, err := rej.Write(s)
+				if err != nil {
+					log.Fatalf("failed to write rejected sequence %q: %v", s.Name(), err)
+				}
 			}
+			continue
+		}
+		kept++
+		_, err := w.Write(s)
+		if err != nil {
+			log.Fatalf("failed to write sequence %q: %v", s.Name(), err)
 		}
 	}
 	err = sc.Error()
 	if err != nil {
 		log.Fatalf("failed during read: %v", err)
 	}
+	log.Printf("kept %d sequences, filtered %d", kept, filtered)
+}
+
+// keep returns whether s is within the length cut-offs and
+// the G+C and N fraction bounds.
+func keep(s *linear.Seq) bool {
+	length := s.Len()
+	if *incl {
+		if length < *min || (*max != 0 && length > *max) {
+			return false
+		}
+	} else if length <= *min || (*max != 0 && length >= *max) {
+		return false
+	}
+	if *minGC <= 0 && *maxGC >= 1 && *maxN >= 1 {
+		return true
+	}
+
+	var ctr [256]int
+	for _, l := range s.Seq {
+		ctr[l|' ']++ // Count lowercased letter.
+	}
+	if length != 0 && float64(ctr['n'])/float64(length) > *maxN {
+		return false
+	}
+	var gc float64
+	if acgt := ctr['a'] + ctr['c'] + ctr['g'] + ctr['t']; acgt != 0 {
+		gc = float64(ctr['g']+ctr['c']) / float64(acgt)
+	}
+	return *minGC <= gc && gc <= *maxGC
 }
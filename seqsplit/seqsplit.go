@@ -24,63 +24,119 @@
 // into (5-1) fragments each of size 5kb. Get the last
 // window+remainder (5000+2582) fragment starting from
 // position 20000 till the end of the contig (27582).
+//
+// With -ratio, the upper bound of fragment lengths is
+// ratio*window, with 1 < ratio ≤ 2. Contigs shorter than
+// ratio*window are not split. The remainder is added to
+// the last fragment only if that keeps it shorter than
+// ratio*window, and is otherwise written as an additional
+// fragment, so that the last fragment of a contig falls
+// in the size range:
+//  (ratio-1)*window ≤ fragment < window.
+// All other fragments are in the size range:
+//  window ≤ fragment < (ratio*window).
+//
+// With -overlap, each fragment starts (window - overlap)
+// after the previous one, so adjacent fragments share
+// overlap bases, and the last fragment extends from the
+// start of the last whole window to the end of the contig.
+//
+// With -split-at-gaps, contigs are first cut at runs of
+// at least -gaplen Ns, which are removed, and each of the
+// remaining segments is then split as described above.
+// Segments shorter than the minimum cut-off length are
+// discarded, and fragments bounded by a gap may be
+// shorter than window.
+//
+// With -unmask, soft-masked lowercase bases are written
+// in uppercase.
+//
+// Input may be gzip compressed, and output is gzip
+// compressed if the output file name ends in ".gz".
+//
+// A summary of the number of contigs read, discarded,
+// written unsplit and split, and of the number of
+// fragments written is printed to stderr.
+//
+// With -format=fastq, the input is read as Sanger encoded
+// FASTQ, fragments carry the quality scores of their
+// bases and are written as FASTQ.
+//
+// The fragmentation is provided by the split package so
+// that it can be shared and tested.
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/biogo/biogo/alphabet"
-	"github.com/biogo/biogo/feat"
 	"github.com/biogo/biogo/io/seqio"
 	"github.com/biogo/biogo/io/seqio/fasta"
+	"github.com/biogo/biogo/io/seqio/fastq"
+	"github.com/biogo/biogo/seq"
 	"github.com/biogo/biogo/seq/linear"
-	"github.com/biogo/biogo/seq/sequtils"
-)
-
-type fe struct {
-	s, e   int
-	orient feat.Orientation
-	feat.Feature
-}
-
-func (f fe) Start() int                    { return f.s }
-func (f fe) End() int                      { return f.e }
-func (f fe) Len() int                      { return f.e - f.s }
-func (f fe) Orientation() feat.Orientation { return f.orient }
 
-type fs []feat.Feature
-
-func (f fs) Features() []feat.Feature { return []feat.Feature(f) }
+	"github.com/biogo/examples/seqsplit/split"
+)
 
 var (
 	inf    = flag.String("in", "", "input contig file name to be fragmented. Defaults to stdin.")
 	outf   = flag.String("out", "", "output file name. Defaults to stdout.")
 	min    = flag.Int("min", 2500, "minimum sequence length cut-off (bp)")
 	window = flag.Int("window", 5000, "sequence window length (bp)")
+	olap   = flag.Int("overlap", 0, "overlap between adjacent fragments (bp)")
+	ratio  = flag.Float64("ratio", 2, "upper bound of fragment length as a multiple of window, in (1, 2]")
+	atGaps = flag.Bool("split-at-gaps", false, "cut contigs at runs of N before splitting into windows")
+	gapLen = flag.Int("gaplen", 10, "minimum length of N runs to cut at with -split-at-gaps (bp)")
+	unmask = flag.Bool("unmask", false, "convert soft-masked lowercase bases to uppercase")
+	format = flag.String("format", "fasta", "input and output format: fasta or fastq")
 	help   = flag.Bool("help", false, "help prints this message.")
 )
 
+// fragment is a sequence that can be split and renamed.
+type fragment interface {
+	seq.Sequence
+	SetName(string) error
+}
+
 func main() {
 	flag.Parse()
 	if *help {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *window < 1 {
+		log.Fatalf("invalid window length: %d", *window)
+	}
+	if *olap < 0 || *olap >= *window {
+		log.Fatalf("invalid overlap: %d", *olap)
+	}
+	if *ratio <= 1 || *ratio > 2 {
+		log.Fatalf("invalid fragment length ratio: %v", *ratio)
+	}
+	if *gapLen < 1 {
+		log.Fatalf("invalid gap length: %d", *gapLen)
+	}
 
 	var in *os.File
 	var err error
-	var r *fasta.Reader
-	t := linear.NewSeq("", nil, alphabet.DNA)
 	if *inf == "" {
-		r = fasta.NewReader(os.Stdin, t)
+		in = os.Stdin
 	} else if in, err = os.Open(*inf); err != nil {
 		log.Fatalf("failed to open %q: %v", *inf, err)
 	} else {
 		defer in.Close()
-		r = fasta.NewReader(in, t)
+	}
+	src, err := maybeGzip(in)
+	if err != nil {
+		log.Fatalf("failed to read %q: %v", *inf, err)
 	}
 
 	var out *os.File
@@ -90,52 +146,82 @@ func main() {
 		log.Fatalf("failed to create %q: %v", *outf, err)
 	}
 	defer out.Close()
+	var dst io.Writer = out
+	if strings.HasSuffix(*outf, ".gz") {
+		gz := gzip.NewWriter(out)
+		defer func() {
+			// The gzip stream must be closed before the
+			// file to flush the remaining output.
+			err := gz.Close()
+			if err != nil {
+				log.Fatalf("failed to close %q: %v", *outf, err)
+			}
+		}()
+		dst = gz
+	}
+
+	var (
+		r seqio.Reader
+		w seqio.Writer
+	)
+	switch *format {
+	case "fasta":
+		r = fasta.NewReader(src, linear.NewSeq("", nil, alphabet.DNA))
+		w = fasta.NewWriter(dst, 60)
+	case "fastq":
+		r = fastq.NewReader(src, linear.NewQSeq("", nil, alphabet.DNA, alphabet.Sanger))
+		w = fastq.NewWriter(dst)
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
 
-	w := fasta.NewWriter(out, 60)
+	sp := split.Splitter{Min: *min, Window: *window, Overlap: *olap, Ratio: *ratio}
+	// Counts of contigs read, discarded, written unsplit
+	// and split, and of fragments written, for the summary.
+	var read, discarded, passed, splitted, fragments int
 	sc := seqio.NewScanner(r)
 	for sc.Next() {
-		next := sc.Seq().(*linear.Seq)
-		curr := linear.NewSeq("", nil, alphabet.DNA)
-		startPos, endPos := 0, 0
+		read++
+		next := sc.Seq().(fragment)
+		if *unmask {
+			toUpper(next)
+		}
+		var frags []split.Fragment
+		if *atGaps {
+			frags = sp.AtGaps(next.Len(), split.Gaps(next, *gapLen))
+		} else {
+			frags = sp.Windows(next.Len())
+		}
 		switch {
-		case len(next.Seq) < *min:
+		case len(frags) == 0:
 			// Discard contigs below the cut-off size limit.
+			discarded++
 			continue
-		case len(next.Seq) >= 2*(*window):
-			remainder := len(next.Seq) % (*window)
-			quotient := len(next.Seq) / (*window)
-			for i := 0; i < (quotient - 1); i++ {
-				startPos = i * (*window)
-				endPos = startPos + (*window)
-				ff := fs{fe{s: startPos, e: endPos}}
-				err := sequtils.Stitch(curr, next, ff)
-				if err != nil {
-					panic(err)
-				}
-				// The fragment sequences require new, unique FASTA
-				// sequence identifiers. Append the start and end positions
-				// of contig sequence to old identifiers and use them as
-				// FASTA headers for the fragments.
-				curr.ID = fmt.Sprintf("%v_%v-%v", next.Name(), startPos, endPos)
-				curr.Desc = next.Desc
-				if _, err = w.Write(curr); err != nil {
-					fmt.Fprintf(os.Stderr, "failed to write window-sized fragment: %v", err)
-				}
+		case len(frags) == 1 && frags[0].Len() == next.Len():
+			// Contig is of desired size range.
+			passed++
+			if _, err = w.Write(next); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write contig: %v", err)
 			}
-			ff := fs{fe{s: endPos, e: endPos + (*window) + remainder}}
-			err := sequtils.Stitch(curr, next, ff)
+			continue
+		}
+		// Clone the contig so that the fragments retain
+		// its annotation, including any quality encoding.
+		curr := next.Clone().(fragment)
+		splitted++
+		fragments += len(frags)
+		for _, f := range frags {
+			err := split.Stitch(curr, next, f)
 			if err != nil {
-				panic(err)
+				log.Fatalf("failed to extract %s:%d-%d: %v", next.Name(), f.Start, f.End, err)
 			}
-			curr.ID = fmt.Sprintf("%v_%v-%v", next.Name(), endPos, endPos+(*window)+remainder)
-			curr.Desc = next.Desc
+			// The fragment sequences require new, unique FASTA
+			// sequence identifiers. Append the start and end positions
+			// of contig sequence to old identifiers and use them as
+			// FASTA headers for the fragments.
+			curr.SetName(fmt.Sprintf("%v_%v-%v", next.Name(), f.Start, f.End))
 			if _, err = w.Write(curr); err != nil {
-				fmt.Fprintf(os.Stderr, "failed to write remainder fragment: %v", err)
-			}
-		default:
-			// Contig is of desired size range.
-			if _, err = w.Write(next); err != nil {
-				fmt.Fprintf(os.Stderr, "failed to write contig: %v", err)
+				fmt.Fprintf(os.Stderr, "failed to write fragment: %v", err)
 			}
 		}
 	}
@@ -143,4 +229,31 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed during read: %v", err)
 	}
+	fmt.Fprintf(os.Stderr, "contigs read: %d\nbelow minimum: %d\nin range: %d\nsplit: %d\nfragments: %d\n",
+		read, discarded, passed, splitted, fragments)
+}
+
+// toUpper converts the lowercase letters of s to uppercase.
+func toUpper(s seq.Sequence) {
+	for i := s.Start(); i < s.End(); i++ {
+		ql := s.At(i)
+		if 'a' <= ql.L && ql.L <= 'z' {
+			ql.L -= 'a' - 'A'
+			s.Set(i, ql)
+		}
+	}
+}
+
+// maybeGzip returns a reader that decompresses r if it
+// holds gzip compressed data, and otherwise reads r unaltered.
+func maybeGzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
 }
@@ -0,0 +1,158 @@
+// Copyright ©2017 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package split provides fragmentation of contig sequences
+// into window sized fragments.
+package split
+
+import (
+	"github.com/biogo/biogo/feat"
+	"github.com/biogo/biogo/seq"
+	"github.com/biogo/biogo/seq/sequtils"
+)
+
+// Fragment is a zero-based, half-open interval of a contig.
+type Fragment struct {
+	Start, End int
+}
+
+// Len returns the length of the fragment.
+func (f Fragment) Len() int { return f.End - f.Start }
+
+// Splitter holds the parameters used to split contigs.
+type Splitter struct {
+	// Min is the minimum contig length. Shorter
+	// contigs are discarded.
+	Min int
+
+	// Window is the fragment length.
+	Window int
+
+	// Overlap is the number of bases shared by
+	// adjacent fragments. It must be less than
+	// Window.
+	Overlap int
+
+	// Ratio is the exclusive upper bound of fragment
+	// lengths as a multiple of Window. It must be in
+	// (1, 2], and if zero, 2 is used.
+	Ratio float64
+}
+
+func (s Splitter) ratio() float64 {
+	if s.Ratio == 0 {
+		return 2
+	}
+	return s.Ratio
+}
+
+// Windows returns the fragments of a contig of the given length.
+// With the default Ratio of 2, each fragment falls in the size range:
+//
+//	window ≤ fragment < (2*window).
+//
+// The contig is sliced from the start into fragments of size
+// window, each starting window-overlap after the previous. The
+// bases remaining after the last whole window are added to the
+// last fragment if that keeps it shorter than ratio*window, and
+// are otherwise returned as an additional fragment, so that:
+//
+//	window ≤ fragment < (ratio*window), or
+//	(ratio-1)*window ≤ last fragment < window.
+//
+// With an overlap of zero, the remainder is length % window.
+//
+// If length is less than Min, Windows returns no fragments. If
+// length is less than ratio*window, the contig is returned as a
+// single fragment.
+func (s Splitter) Windows(length int) []Fragment {
+	switch {
+	case length < s.Min:
+		return nil
+	case float64(length) < s.ratio()*float64(s.Window):
+		return []Fragment{{Start: 0, End: length}}
+	}
+	step := s.Window - s.Overlap
+	frags := make([]Fragment, (length-s.Window)/step+1)
+	for i := range frags {
+		frags[i] = Fragment{Start: i * step, End: i*step + s.Window}
+	}
+	last := &frags[len(frags)-1]
+	if float64(length-last.Start) < s.ratio()*float64(s.Window) {
+		last.End = length
+	} else {
+		frags = append(frags, Fragment{Start: last.Start + step, End: length})
+	}
+	return frags
+}
+
+// Gaps returns the runs of N in s that are at least minLen long.
+func Gaps(s seq.Sequence, minLen int) []Fragment {
+	var (
+		gaps  []Fragment
+		start = -1
+	)
+	for i := 0; i <= s.Len(); i++ {
+		if i < s.Len() && s.At(i).L|' ' == 'n' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start >= minLen {
+			gaps = append(gaps, Fragment{Start: start, End: i})
+		}
+		start = -1
+	}
+	return gaps
+}
+
+// AtGaps returns the fragments of a contig of the given length,
+// cutting first at the given gaps, which are excluded from the
+// fragments, and then dividing each remaining segment as described
+// for Windows. Segments shorter than Min are dropped, so fragments
+// cut at a gap may be shorter than Window. The gaps must be sorted
+// and non-overlapping.
+func (s Splitter) AtGaps(length int, gaps []Fragment) []Fragment {
+	if length < s.Min {
+		return nil
+	}
+	var (
+		frags []Fragment
+		start int
+	)
+	for i := 0; i <= len(gaps); i++ {
+		end := length
+		if i < len(gaps) {
+			end = gaps[i].Start
+		}
+		for _, f := range s.Windows(end - start) {
+			frags = append(frags, Fragment{Start: f.Start + start, End: f.End + start})
+		}
+		if i < len(gaps) {
+			start = gaps[i].End
+		}
+	}
+	return frags
+}
+
+type fe struct {
+	s, e   int
+	orient feat.Orientation
+	feat.Feature
+}
+
+func (f fe) Start() int                    { return f.s }
+func (f fe) End() int                      { return f.e }
+func (f fe) Len() int                      { return f.e - f.s }
+func (f fe) Orientation() feat.Orientation { return f.orient }
+
+type fs []feat.Feature
+
+func (f fs) Features() []feat.Feature { return []feat.Feature(f) }
+
+// Stitch places the subsequence of src defined by f in dst.
+func Stitch(dst, src sequtils.Sliceable, f Fragment) error {
+	return sequtils.Stitch(dst, src, fs{fe{s: f.Start, e: f.End}})
+}
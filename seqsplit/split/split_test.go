@@ -0,0 +1,175 @@
+// Copyright ©2017 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package split
+
+import (
+	"testing"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/seq/linear"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestWindows(c *check.C) {
+	for i, t := range []struct {
+		length, min, window int
+		overlap             int
+		frags               []Fragment
+	}{
+		{length: 2499, min: 2500, window: 5000, frags: nil},
+		{length: 2500, min: 2500, window: 5000, frags: []Fragment{{0, 2500}}},
+		{length: 9999, min: 2500, window: 5000, frags: []Fragment{{0, 9999}}},
+		{length: 10000, min: 2500, window: 5000, frags: []Fragment{{0, 5000}, {5000, 10000}}},
+		{
+			length: 27582, min: 2500, window: 5000,
+			frags: []Fragment{{0, 5000}, {5000, 10000}, {10000, 15000}, {15000, 20000}, {20000, 27582}},
+		},
+		{length: 9999, min: 2500, window: 5000, overlap: 1000, frags: []Fragment{{0, 9999}}},
+		{
+			length: 10000, min: 2500, window: 5000, overlap: 1000,
+			frags: []Fragment{{0, 5000}, {4000, 10000}},
+		},
+		{
+			length: 27582, min: 2500, window: 5000, overlap: 1000,
+			frags: []Fragment{{0, 5000}, {4000, 9000}, {8000, 13000}, {12000, 17000}, {16000, 21000}, {20000, 27582}},
+		},
+	} {
+		frags := Splitter{Min: t.min, Window: t.window, Overlap: t.overlap}.Windows(t.length)
+		c.Check(frags, check.DeepEquals, t.frags, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestWindowsTile(c *check.C) {
+	const min, window = 10, 7
+	for overlap := 0; overlap < window; overlap++ {
+		for length := 2 * window; length < 20*window; length++ {
+			frags := Splitter{Min: min, Window: window, Overlap: overlap}.Windows(length)
+			end := overlap
+			for _, f := range frags {
+				c.Check(f.Start, check.Equals, end-overlap, check.Commentf("length %d overlap %d", length, overlap))
+				c.Check(f.Len() >= window && f.Len() < 2*window, check.Equals, true,
+					check.Commentf("length %d overlap %d: fragment %v", length, overlap, f))
+				end = f.End
+			}
+			c.Check(end, check.Equals, length)
+		}
+	}
+}
+
+func (s *S) TestWindowsRatio(c *check.C) {
+	for i, t := range []struct {
+		length, window, overlap int
+		ratio                   float64
+		frags                   []Fragment
+	}{
+		{length: 14, window: 10, ratio: 1.5, frags: []Fragment{{0, 14}}},
+		{length: 15, window: 10, ratio: 1.5, frags: []Fragment{{0, 10}, {10, 15}}},
+		{length: 19, window: 10, ratio: 1.5, frags: []Fragment{{0, 10}, {10, 19}}},
+		{length: 24, window: 10, ratio: 1.5, frags: []Fragment{{0, 10}, {10, 24}}},
+		{length: 25, window: 10, ratio: 1.5, frags: []Fragment{{0, 10}, {10, 20}, {20, 25}}},
+		{length: 25, window: 10, ratio: 2, frags: []Fragment{{0, 10}, {10, 25}}},
+		{length: 26, window: 10, overlap: 2, ratio: 1.5, frags: []Fragment{{0, 10}, {8, 18}, {16, 26}}},
+		{length: 22, window: 10, overlap: 2, ratio: 1.5, frags: []Fragment{{0, 10}, {8, 22}}},
+		{length: 23, window: 10, overlap: 2, ratio: 1.5, frags: []Fragment{{0, 10}, {8, 18}, {16, 23}}},
+	} {
+		frags := Splitter{Window: t.window, Overlap: t.overlap, Ratio: t.ratio}.Windows(t.length)
+		c.Check(frags, check.DeepEquals, t.frags, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestWindowsRatioBounds(c *check.C) {
+	const window = 20
+	for _, ratio := range []float64{1.1, 1.25, 1.5, 1.75, 2} {
+		for length := window; length < 20*window; length++ {
+			frags := Splitter{Window: window, Ratio: ratio}.Windows(length)
+			for j, f := range frags {
+				lo := float64(window)
+				if j == len(frags)-1 && j != 0 {
+					lo = ratio*window - window
+				}
+				ok := float64(f.Len()) >= lo && float64(f.Len()) < ratio*window
+				c.Check(ok, check.Equals, true, check.Commentf("length %d ratio %v: fragment %v", length, ratio, f))
+			}
+		}
+	}
+}
+
+func (s *S) TestStitch(c *check.C) {
+	src := linear.NewSeq("a", alphabet.BytesToLetters([]byte("ACGTACGTTT")), alphabet.DNA)
+	dst := linear.NewSeq("", nil, alphabet.DNA)
+	err := Stitch(dst, src, Fragment{Start: 2, End: 7})
+	c.Assert(err, check.Equals, nil)
+	c.Check(string(alphabet.Letters(dst.Seq)), check.Equals, "GTACG")
+}
+
+func (s *S) TestFragmentsContiguous(c *check.C) {
+	const window = 5
+	b := []byte("ACGTTGCAACGTTGCAACGTTGCAACGTTGCAAC")
+	src := linear.NewSeq("a", alphabet.BytesToLetters(b), alphabet.DNA)
+	var (
+		got  []byte
+		prev Fragment
+	)
+	for i, f := range (Splitter{Window: window}).Windows(src.Len()) {
+		if i != 0 {
+			c.Check(f.Start, check.Equals, prev.End, check.Commentf("fragment %d", i))
+		}
+		dst := linear.NewSeq("", nil, alphabet.DNA)
+		err := Stitch(dst, src, f)
+		c.Assert(err, check.Equals, nil)
+		c.Check(dst.Len(), check.Equals, f.Len())
+		got = append(got, alphabet.Letters(dst.Seq).String()...)
+		prev = f
+	}
+	c.Check(string(got), check.Equals, string(b))
+}
+
+func (s *S) TestGaps(c *check.C) {
+	for i, t := range []struct {
+		seq    string
+		minLen int
+		gaps   []Fragment
+	}{
+		{seq: "ACGT", minLen: 1, gaps: nil},
+		{seq: "NNACGTnnnACNNNN", minLen: 3, gaps: []Fragment{{6, 9}, {11, 15}}},
+		{seq: "NNACGTnnnACNNNN", minLen: 2, gaps: []Fragment{{0, 2}, {6, 9}, {11, 15}}},
+		{seq: "NNACGTnnnACNNNN", minLen: 5, gaps: nil},
+	} {
+		src := linear.NewSeq("a", alphabet.BytesToLetters([]byte(t.seq)), alphabet.DNA)
+		c.Check(Gaps(src, t.minLen), check.DeepEquals, t.gaps, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestAtGaps(c *check.C) {
+	for i, t := range []struct {
+		length, min, window int
+		gaps                []Fragment
+		frags               []Fragment
+	}{
+		{length: 5, min: 6, window: 5, frags: nil},
+		{length: 25, min: 3, window: 5, frags: []Fragment{{0, 5}, {5, 10}, {10, 15}, {15, 20}, {20, 25}}},
+		{
+			length: 25, min: 3, window: 5,
+			gaps:  []Fragment{{7, 9}, {20, 21}},
+			frags: []Fragment{{0, 7}, {9, 14}, {14, 20}, {21, 25}},
+		},
+		{
+			// Segments shorter than min are dropped.
+			length: 25, min: 3, window: 5,
+			gaps:  []Fragment{{0, 1}, {3, 9}, {23, 25}},
+			frags: []Fragment{{9, 14}, {14, 23}},
+		},
+	} {
+		frags := Splitter{Min: t.min, Window: t.window}.AtGaps(t.length, t.gaps)
+		c.Check(frags, check.DeepEquals, t.frags, check.Commentf("Test %d", i))
+	}
+}
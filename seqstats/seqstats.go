@@ -3,16 +3,36 @@
 // license that can be found in the LICENSE file.
 
 // seqstats calculates and prints sequence statistics from
-// a multi-FASTA DNA sequence file (default stdin). It
-// is useful for analyzing metrics of microbial genome
-// assemblies or metagenome "bins". It prints: the total
-// no. of sequences, assembly size (total length of all
-// sequences), Min, Max, Avg, N50 and G+C ratio.
+// a multi-FASTA DNA sequence file (default stdin), which
+// may be gzip compressed. It is useful for analyzing
+// metrics of microbial genome assemblies or metagenome
+// "bins". It prints: the total no. of sequences, assembly
+// size (total length of all sequences), Min, Max, Avg,
+// N50, L50, N90, L90, the number of ambiguous (N) bases
+// and the fraction of the assembly they make up, and G+C
+// ratio, both excluding and including N bases in the
+// assembly size.
+//
+// Soft-masked (lowercase) bases are counted. With -iupac,
+// ambiguity codes contribute to the G+C count according
+// to the fraction of the bases they represent that are
+// G or C.
+//
+// Multiple files may be given as arguments, in which case
+// one row of a tab-separated table with a header row is
+// printed per file. With -json the statistics are printed
+// as a JSON object per file. If an input holds no
+// sequences, a warning is logged and zeroed statistics
+// are printed with exit status 0.
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -31,19 +51,28 @@ const MaxInt = int(^uint(0) >> 1)
 // any extension and other reported statistics in bp
 // (base pairs).
 type binStats struct {
-	name    string // From input filename (empty, if stdin).
-	totSeqs int
-	size    int
-	min     int
-	max     int
-	avg     float64
-	n50     int
-	perGC   float64
+	Name    string  `json:"name"` // From input filename (empty, if stdin).
+	TotSeqs int     `json:"totSeqs"`
+	Size    int     `json:"size"`
+	Min     int     `json:"min"`
+	Max     int     `json:"max"`
+	Avg     float64 `json:"avg"`
+	N50     int     `json:"n50"`
+	L50     int     `json:"l50"`
+	N90     int     `json:"n90"`
+	L90     int     `json:"l90"`
+	NCount  int     `json:"nCount"`
+	GapFrac float64 `json:"gapFrac"`  // Fraction of size that is N.
+	PerGC   float64 `json:"perGC"`    // Excluding N from size.
+	RawGC   float64 `json:"perGCRaw"` // Including N in size.
 }
 
 var (
-	ctgf = flag.String("in", "", "input contig file, defaults to stdin")
-	help = flag.Bool("help", false, "help prints this message")
+	ctgf  = flag.String("in", "", "input contig file, defaults to stdin if no files are given as arguments")
+	iupac = flag.Bool("iupac", false, "weight IUPAC ambiguity codes by their G+C content")
+	asJS  = flag.Bool("json", false, "print statistics as JSON, one object per line")
+	asTSV = flag.Bool("tsv", false, "print statistics as a tab-separated table, the default for multiple files")
+	help  = flag.Bool("help", false, "help prints this message")
 )
 
 func main() {
@@ -53,59 +82,182 @@ func main() {
 		os.Exit(0)
 	}
 
-	var in *os.File
-	var r *fasta.Reader
-	var err error
-	t := linear.NewSeq("", nil, alphabet.DNA)
-	if *ctgf == "" {
-		r = fasta.NewReader(os.Stdin, t)
-	} else if in, err = os.Open(*ctgf); err != nil {
-		log.Fatalf("failed to open %q: %v", *ctgf, err)
-		os.Exit(1)
-	} else {
-		defer in.Close()
-		r = fasta.NewReader(in, t)
+	files := flag.Args()
+	if *ctgf != "" {
+		files = append([]string{*ctgf}, files...)
 	}
+	if len(files) == 0 {
+		// Read stdin as a single unnamed entry.
+		files = []string{""}
+	}
+	tsv := *asTSV || len(files) > 1
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	if tsv && !*asJS {
+		fmt.Fprintln(w, tsvHeader)
+	}
+	for _, f := range files {
+		b, err := fileStats(f, *iupac)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if b.TotSeqs == 0 {
+			// Zeroed statistics are still printed so that
+			// the output can always be parsed.
+			log.Printf("no sequences in %q", f)
+		}
+		switch {
+		case *asJS:
+			err = enc.Encode(b)
+		case tsv:
+			err = writeTSVRow(w, b)
+		default:
+			// Print the statistics of the assembly as key:value pairs.
+			_, err = fmt.Fprintf(w, "%+v\n", b)
+		}
+		if err != nil {
+			log.Fatalf("failed to write statistics: %v", err)
+		}
+	}
+}
 
+// tsvHeader is the header row for tab-separated output.
+const tsvHeader = "name\ttotSeqs\tsize\tmin\tmax\tavg\tn50\tl50\tn90\tl90\tnCount\tgapFrac\tperGC\tperGCRaw"
+
+// writeTSVRow writes b to w as a tab-separated row with the
+// columns given in tsvHeader.
+func writeTSVRow(w io.Writer, b binStats) error {
+	_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.2f\t%d\t%d\t%d\t%d\t%d\t%.4f\t%.2f\t%.2f\n",
+		b.Name, b.TotSeqs, b.Size, b.Min, b.Max, b.Avg,
+		b.N50, b.L50, b.N90, b.L90, b.NCount, b.GapFrac, b.PerGC, b.RawGC)
+	return err
+}
+
+// fileStats returns the statistics for the FASTA file at path,
+// which may be gzip compressed. If path is empty, stdin is read.
+// The returned Name is the basename of path without extensions.
+func fileStats(path string, iupac bool) (binStats, error) {
+	var in io.Reader = os.Stdin
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return binStats{}, fmt.Errorf("failed to open %q: %v", path, err)
+		}
+		defer f.Close()
+		in = f
+	}
+	r, err := maybeGzip(in)
+	if err != nil {
+		return binStats{}, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+
+	b, err := assemblyStats(r, iupac)
+	if err != nil {
+		return binStats{}, fmt.Errorf("failed during read of %q: %v", path, err)
+	}
+	if path != "" {
+		base := strings.TrimSuffix(filepath.Base(path), ".gz")
+		b.Name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return b, nil
+}
+
+// maybeGzip returns a reader that decompresses r if it
+// holds gzip compressed data, and otherwise reads r unaltered.
+func maybeGzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// gcWeight is the fraction of the bases represented by each
+// lowercase IUPAC nucleotide code that are G or C.
+var gcWeight = map[byte]float64{
+	'g': 1, 'c': 1, 's': 1,
+	'r': 0.5, 'y': 0.5, 'k': 0.5, 'm': 0.5,
+	'b': 2. / 3, 'v': 2. / 3,
+	'd': 1. / 3, 'h': 1. / 3,
+}
+
+// assemblyStats returns the statistics for the FASTA sequences
+// read from r. If r holds no sequences, all statistics are zero.
+// G+C is counted without regard to case. If iupac is true,
+// ambiguity codes contribute to the G+C count according to
+// gcWeight, otherwise only G and C are counted.
+func assemblyStats(r io.Reader, iupac bool) (binStats, error) {
 	var b binStats
 	var ctr [256]int
 	var seqlens []int
-	sc := seqio.NewScanner(r)
-	b.name = strings.TrimSuffix(filepath.Base(*ctgf), filepath.Ext(*ctgf))
-	b.min = MaxInt
+	sc := seqio.NewScanner(fasta.NewReader(r, linear.NewSeq("", nil, alphabet.DNA)))
+	b.Min = MaxInt
 
 	for sc.Next() {
 		s := sc.Seq()
 		for _, l := range s.(*linear.Seq).Seq {
 			ctr[l|' ']++ // Count lowercased letter.
 		}
-		b.totSeqs++
-		b.size += s.Len()
+		b.TotSeqs++
+		b.Size += s.Len()
 		seqlens = append(seqlens, s.Len())
-		if s.Len() < b.min {
-			b.min = s.Len()
+		if s.Len() < b.Min {
+			b.Min = s.Len()
 		}
-		if s.Len() > b.max {
-			b.max = s.Len()
+		if s.Len() > b.Max {
+			b.Max = s.Len()
 		}
 	}
-	err = sc.Error()
+	err := sc.Error()
 	if err != nil {
-		log.Fatalf("failed during read: %v", err)
+		return binStats{}, err
+	}
+	if b.TotSeqs == 0 {
+		return binStats{}, nil
 	}
 
 	// Sort in descending order of sequence length.
 	sort.Sort(sort.Reverse(sort.IntSlice(seqlens)))
+	b.N50, b.L50 = nx(seqlens, b.Size, 50)
+	b.N90, b.L90 = nx(seqlens, b.Size, 90)
+	b.Avg = float64(b.Size) / float64(b.TotSeqs)
+	b.NCount = ctr['n']
+	gc := float64(ctr['g'] + ctr['c'])
+	if iupac {
+		gc = 0
+		for l, w := range gcWeight {
+			gc += w * float64(ctr[l])
+		}
+	}
+	if b.Size != 0 {
+		b.GapFrac = float64(b.NCount) / float64(b.Size)
+		b.RawGC = gc / float64(b.Size) * 100
+	}
+	if b.Size != b.NCount {
+		b.PerGC = gc / float64(b.Size-b.NCount) * 100
+	}
+	return b, nil
+}
+
+// nx returns the Nx and Lx statistics for the sequence lengths in
+// seqlens, which must be sorted in descending order and sum to size.
+// Nx is the length of the shortest sequence in the smallest set of
+// longest sequences that together make up at least x percent of size,
+// and Lx is the number of sequences in that set.
+func nx(seqlens []int, size, x int) (n, l int) {
 	// csum stores the cumulative sequence length.
-	for i, csum := 1, seqlens[0]; i < len(seqlens); i++ {
-		if csum >= (b.size / 2) {
-			b.n50 = seqlens[i]
-			break
+	var csum int
+	for i, sl := range seqlens {
+		csum += sl
+		if csum*100 >= size*x {
+			return sl, i + 1
 		}
-		csum = seqlens[i] + csum
 	}
-	b.avg = float64(b.size) / float64(b.totSeqs)
-	b.perGC = float64(ctr['g']+ctr['c']) / float64(ctr['a']+ctr['t']+ctr['g']+ctr['c']) * 100
-	// Print the statistics of the assembly as key:value pairs.
-	fmt.Printf("%+v\n", b)
+	return 0, 0
 }
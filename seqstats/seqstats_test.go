@@ -0,0 +1,107 @@
+// Copyright ©2017 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestEmpty(c *check.C) {
+	for i, in := range []string{"", "\n"} {
+		b, err := assemblyStats(strings.NewReader(in), false)
+		c.Check(err, check.Equals, nil, check.Commentf("Test %d", i))
+		c.Check(b, check.Equals, binStats{}, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestGC(c *check.C) {
+	for i, t := range []struct {
+		in    string
+		iupac bool
+		gc    float64
+	}{
+		{in: ">a\nACGT\n", gc: 50},
+		{in: ">a\nacgt\n", gc: 50},
+		{in: ">a\nGCgcATat\n>b\nggcc\n", gc: 200. / 3},
+		{in: ">a\nACGTnnnn\n", gc: 50},
+		{in: ">a\nGGSSWW\n", gc: 100. / 3},
+		{in: ">a\nGGSSWW\n", iupac: true, gc: 200. / 3},
+		{in: ">a\nrywt\n", iupac: true, gc: 25},
+	} {
+		b, err := assemblyStats(strings.NewReader(t.in), t.iupac)
+		c.Assert(err, check.Equals, nil, check.Commentf("Test %d", i))
+		c.Check(math.Abs(b.PerGC-t.gc) < 1e-9, check.Equals, true, check.Commentf("Test %d: got %v want %v", i, b.PerGC, t.gc))
+	}
+}
+
+func (s *S) TestNx(c *check.C) {
+	for i, t := range []struct {
+		seqlens []int
+		x       int
+		n, l    int
+	}{
+		{seqlens: nil, x: 50},
+		{seqlens: []int{10}, x: 50, n: 10, l: 1},
+		{seqlens: []int{10}, x: 90, n: 10, l: 1},
+		// Half of the size is reached exactly at the first sequence.
+		{seqlens: []int{5, 3, 2}, x: 50, n: 5, l: 1},
+		{seqlens: []int{5, 3, 2}, x: 90, n: 2, l: 3},
+		{seqlens: []int{8, 5, 4, 3, 2, 2}, x: 50, n: 5, l: 2},
+		{seqlens: []int{8, 5, 4, 3, 2, 2}, x: 90, n: 2, l: 5},
+		{seqlens: []int{4, 4, 4, 4}, x: 50, n: 4, l: 2},
+	} {
+		var size int
+		for _, l := range t.seqlens {
+			size += l
+		}
+		n, l := nx(t.seqlens, size, t.x)
+		c.Check(n, check.Equals, t.n, check.Commentf("Test %d", i))
+		c.Check(l, check.Equals, t.l, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestN(c *check.C) {
+	b, err := assemblyStats(strings.NewReader(">a\nGCATnnNN\n>b\nGGCC\n"), false)
+	c.Assert(err, check.Equals, nil)
+	c.Check(b.NCount, check.Equals, 4)
+	c.Check(b.GapFrac, check.Equals, 4./12)
+	c.Check(b.PerGC, check.Equals, 75.)
+	c.Check(b.RawGC, check.Equals, 50.)
+}
+
+func (s *S) TestOutput(c *check.C) {
+	b, err := assemblyStats(strings.NewReader(">a\nGCATnnNN\n>b\nGGCC\n"), false)
+	c.Assert(err, check.Equals, nil)
+	b.Name = "bin"
+
+	var buf bytes.Buffer
+	err = writeTSVRow(&buf, b)
+	c.Assert(err, check.Equals, nil)
+	c.Check(strings.Count(tsvHeader, "\t"), check.Equals, strings.Count(buf.String(), "\t"))
+	c.Check(buf.String(), check.Equals, "bin\t2\t12\t4\t8\t6.00\t8\t1\t4\t2\t4\t0.3333\t75.00\t50.00\n")
+
+	buf.Reset()
+	err = json.NewEncoder(&buf).Encode(b)
+	c.Assert(err, check.Equals, nil)
+	var got map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &got)
+	c.Assert(err, check.Equals, nil)
+	for _, k := range strings.Split(tsvHeader, "\t") {
+		_, ok := got[k]
+		c.Check(ok, check.Equals, true, check.Commentf("missing JSON field %q", k))
+	}
+}
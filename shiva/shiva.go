@@ -23,6 +23,10 @@ func main() {
 	inName := flag.String("in", "", "Filename for input. Defaults to stdin.")
 	outName := flag.String("out", "", "Filename for output. Defaults to stdout.")
 	size := flag.Int("size", 40, "Fragment size.")
+	minLen := flag.Int("minlen", 20, "Minimum sequence length. Shorter sequences are dropped.")
+	maxLen := flag.Int("maxlen", 85, "Maximum sequence length to trim. Longer sequences are fragmented.")
+	trim := flag.Int("trim", 5, "Number of bases to trim from the 5' end of sequences that are not fragmented.")
+	remainder := flag.String("remainder", "drop", "Handling of the partial fragment at the end of fragmented sequences: drop, short (write as a short fragment) or merge (add to the last fragment).")
 	width := flag.Int("width", 60, "Fasta output width.")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to this file.")
 	help := flag.Bool("help", false, "Print this usage message.")
@@ -34,6 +38,18 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *size < 1 || *trim < 0 || *trim >= *minLen || *minLen > *maxLen {
+		fmt.Fprintf(os.Stderr, "Error: invalid lengths: require 0 <= trim < minlen <= maxlen and size > 0.")
+		os.Exit(1)
+	}
+
+	switch *remainder {
+	case "drop", "short", "merge":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown remainder handling %q.", *remainder)
+		os.Exit(1)
+	}
+
 	if *cpuprofile != "" {
 		if profile, err = os.Create(*cpuprofile); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v.", err)
@@ -68,24 +84,75 @@ func main() {
 		out = fasta.NewWriter(buf, *width)
 	}
 
-	var trunc *linear.Seq
+	fr := fragmenter{minLen: *minLen, maxLen: *maxLen, trim: *trim, size: *size, remainder: *remainder}
 	for {
 		s, err := in.Read()
 		if err != nil {
 			break
 		}
-		length := s.Len()
-		li := s.(*linear.Seq)
-		trunc.ID = li.ID
-		switch {
-		case length >= 20 && length <= 85:
-			t.Seq = li.Seq[5:]
-			out.Write(t)
-		case length > 85:
-			for start := 0; start+*size <= length; start += *size {
-				t.Seq = li.Seq[start : start+*size]
-				out.Write(t)
+		for _, f := range fr.fragments(s.(*linear.Seq)) {
+			out.Write(f)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "dropped: %d\ntrimmed: %d\nfragmented: %d\nfragments: %d\n",
+		fr.dropped, fr.trimmed, fr.fragmented, fr.emitted)
+}
+
+// fragmenter holds the length bands used to process sequences.
+type fragmenter struct {
+	minLen, maxLen int
+	trim           int
+	size           int
+
+	// remainder is the handling of the partial
+	// fragment at the end of a sequence, "drop",
+	// "short" or "merge".
+	remainder string
+
+	// Counts of sequences dropped, trimmed and
+	// fragmented, and of fragments returned.
+	dropped, trimmed, fragmented int
+	emitted                      int
+}
+
+// fragments returns the sequences to write for s. Sequences of length
+// minLen to maxLen are trimmed of their first trim bases and keep the
+// ID of s, longer sequences are split into fragments of length size,
+// and shorter sequences are dropped. The ID of each fragment is the ID
+// of s with the zero-based, half-open fragment coordinates appended.
+//
+// The bases after the last whole fragment are dropped unless remainder
+// is "short", when they are written as a shorter fragment, or "merge",
+// when they are added to the last whole fragment.
+func (fr *fragmenter) fragments(s *linear.Seq) []*linear.Seq {
+	var frags []*linear.Seq
+	length := s.Len()
+	switch {
+	case length < fr.minLen:
+		fr.dropped++
+	case length <= fr.maxLen:
+		fr.trimmed++
+		frags = append(frags, linear.NewSeq(s.ID, s.Seq[fr.trim:], s.Alpha))
+	default:
+		fr.fragmented++
+		var bounds [][2]int
+		start := 0
+		for ; start+fr.size <= length; start += fr.size {
+			bounds = append(bounds, [2]int{start, start + fr.size})
+		}
+		if start < length {
+			switch {
+			case fr.remainder == "merge" && len(bounds) != 0:
+				bounds[len(bounds)-1][1] = length
+			case fr.remainder == "short", fr.remainder == "merge":
+				bounds = append(bounds, [2]int{start, length})
 			}
 		}
+		for _, b := range bounds {
+			id := fmt.Sprintf("%s_%d-%d", s.ID, b[0], b[1])
+			frags = append(frags, linear.NewSeq(id, s.Seq[b[0]:b[1]], s.Alpha))
+		}
 	}
+	fr.emitted += len(frags)
+	return frags
 }
@@ -0,0 +1,87 @@
+// Copyright ©2017 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/seq/linear"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+// defaults holds the default shiva length bands.
+var defaults = fragmenter{minLen: 20, maxLen: 85, trim: 5, size: 40}
+
+func (s *S) TestFragments(c *check.C) {
+	type frag struct {
+		id, seq string
+	}
+	for i, t := range []struct {
+		id, seq string
+		fr      fragmenter
+		frags   []frag
+	}{
+		{id: "tiny", seq: strings.Repeat("A", 19), fr: defaults},
+		{
+			id: "short", seq: "GGGGG" + strings.Repeat("ACGT", 5), fr: defaults,
+			frags: []frag{{"short", strings.Repeat("ACGT", 5)}},
+		},
+		{
+			id: "long", seq: strings.Repeat("A", 40) + strings.Repeat("C", 40) + strings.Repeat("G", 10), fr: defaults,
+			frags: []frag{{"long_0-40", strings.Repeat("A", 40)}, {"long_40-80", strings.Repeat("C", 40)}},
+		},
+		{
+			id: "short_tail", seq: strings.Repeat("A", 40) + strings.Repeat("C", 40) + strings.Repeat("G", 10),
+			fr:    fragmenter{minLen: 20, maxLen: 85, trim: 5, size: 40, remainder: "short"},
+			frags: []frag{{"short_tail_0-40", strings.Repeat("A", 40)}, {"short_tail_40-80", strings.Repeat("C", 40)}, {"short_tail_80-90", strings.Repeat("G", 10)}},
+		},
+		{
+			id: "merge_tail", seq: strings.Repeat("A", 40) + strings.Repeat("C", 40) + strings.Repeat("G", 10),
+			fr:    fragmenter{minLen: 20, maxLen: 85, trim: 5, size: 40, remainder: "merge"},
+			frags: []frag{{"merge_tail_0-40", strings.Repeat("A", 40)}, {"merge_tail_40-90", strings.Repeat("C", 40) + strings.Repeat("G", 10)}},
+		},
+		{
+			// With no whole fragment, a merged remainder is written alone.
+			id: "merge_only", seq: strings.Repeat("A", 90),
+			fr:    fragmenter{minLen: 20, maxLen: 85, trim: 5, size: 100, remainder: "merge"},
+			frags: []frag{{"merge_only_0-90", strings.Repeat("A", 90)}},
+		},
+		{
+			id: "custom", seq: "GG" + strings.Repeat("ACGT", 3), fr: fragmenter{minLen: 10, maxLen: 14, trim: 2, size: 5},
+			frags: []frag{{"custom", strings.Repeat("ACGT", 3)}},
+		},
+		{
+			id: "custom", seq: strings.Repeat("ACGTA", 3), fr: fragmenter{minLen: 10, maxLen: 14, trim: 2, size: 5},
+			frags: []frag{{"custom_0-5", "ACGTA"}, {"custom_5-10", "ACGTA"}, {"custom_10-15", "ACGTA"}},
+		},
+	} {
+		src := linear.NewSeq(t.id, alphabet.BytesToLetters([]byte(t.seq)), alphabet.DNA)
+		var got []frag
+		for _, f := range t.fr.fragments(src) {
+			got = append(got, frag{f.ID, f.Seq.String()})
+		}
+		c.Check(got, check.DeepEquals, t.frags, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestCounts(c *check.C) {
+	fr := defaults
+	for _, l := range []int{10, 19, 20, 50, 85, 86, 120} {
+		fr.fragments(linear.NewSeq("", alphabet.BytesToLetters([]byte(strings.Repeat("A", l))), alphabet.DNA))
+	}
+	c.Check(fr.dropped, check.Equals, 2)
+	c.Check(fr.trimmed, check.Equals, 3)
+	c.Check(fr.fragmented, check.Equals, 2)
+	c.Check(fr.emitted, check.Equals, 3+2+3)
+}
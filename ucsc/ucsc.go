@@ -6,10 +6,12 @@
 // UCSC exported FASTA sequences and parses the location information in the
 // sequence description into the sequence metadata, converting the 1-based
 // UCSC position information into 0-based half-open used by bíogo. It then
-// prints out the FASTA, preceded by a summary of the location.
+// prints out the FASTA, preceded by a summary of the location. With -unpad,
+// the reported start and end exclude the 5' and 3' padding.
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"strings"
@@ -44,7 +46,10 @@ ATCTTAGACATGATTATATATGAATATCATTAATCATTAGTTGATAGCAA
 TTACTCTTTATTCCAATATTATAATAATCCTCCCTCT
 `
 
+var unpad = flag.Bool("unpad", false, "report feature start and end excluding padding")
+
 func main() {
+	flag.Parse()
 	buf := strings.NewReader(fa)
 	r := fasta.NewReader(buf, ucsc.NewSeq("", nil, alphabet.DNA))
 	for {
@@ -55,7 +60,11 @@ func main() {
 			}
 			break
 		}
+		start, end := s.Start(), s.End()
+		if *unpad {
+			start, end = s.(ucsc.Seq).Unpadded()
+		}
 		fmt.Printf("\nChr:%s Start:%d End:%d Len:%d Strand:%v\n\n%60a\n",
-			s.Location(), s.Start(), s.End(), s.Len(), seq.Strand(s.(feat.Orienter).Orientation()), s)
+			s.Location(), start, end, s.Len(), seq.Strand(s.(feat.Orienter).Orientation()), s)
 	}
 }
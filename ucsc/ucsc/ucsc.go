@@ -7,6 +7,7 @@
 package ucsc
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -26,31 +27,58 @@ func (c Chr) Name() string           { return string(c) }
 func (c Chr) Description() string    { return "chromosome" }
 func (c Chr) Location() feat.Feature { return nil }
 
+const (
+	rangeField    = "range="
+	strandField   = "strand="
+	fivePadField  = "5'pad="
+	threePadField = "3'pad="
+)
+
 // Seq modifies the behaviour of linear.Seq so that the description is parsed
-// according to the UCSC format.
+// according to the UCSC format. Seq values should be created with NewSeq.
 type Seq struct {
 	*linear.Seq
+	*Pad
+}
+
+// Pad holds the number of bases of flanking sequence added to the 5' and 3'
+// ends of a UCSC sequence.
+type Pad struct {
+	FivePad, ThreePad int
 }
 
 // NewSeq returns a new Seq.
 func NewSeq(id string, b []alphabet.Letter, alpha alphabet.Alphabet) Seq {
-	return Seq{linear.NewSeq(id, b, alpha)}
+	return Seq{linear.NewSeq(id, b, alpha), &Pad{}}
 }
 
 // Clone returns a copy of the Seq.
 func (s Seq) Clone() seq.Sequence {
-	return Seq{s.Seq.Clone().(*linear.Seq)}
+	var p Pad
+	if s.Pad != nil {
+		p = *s.Pad
+	}
+	return Seq{s.Seq.Clone().(*linear.Seq), &p}
+}
+
+// Unpadded returns the 0-based half-open start and end of the sequence
+// excluding the 5' and 3' padding. The 5' padding is at the end of
+// sequences on the minus strand.
+func (s Seq) Unpadded() (start, end int) {
+	start, end = s.Start(), s.End()
+	if s.Pad == nil {
+		return start, end
+	}
+	if s.Strand == seq.Minus {
+		return start + s.ThreePad, end - s.FivePad
+	}
+	return start + s.FivePad, end - s.ThreePad
 }
 
 // SetDescription sets the Desc of the embedded linear.Seq and parses
 // the relevant fields of the description to populate the location, offset
-// and strand fields of the sequence annotation.
+// and strand fields of the sequence annotation, and the padding of the Seq.
 func (s Seq) SetDescription(d string) error {
-	const (
-		rangeField  = "range="
-		strandField = "strand="
-	)
-
 	var (
 		start int
 		err   error
@@ -77,9 +105,58 @@ func (s Seq) SetDescription(d string) error {
 			} else if st[0] == '-' {
 				s.Strand = seq.Minus
 			}
+		case strings.HasPrefix(f, fivePadField) && s.Pad != nil:
+			var perr error
+			s.FivePad, perr = strconv.Atoi(f[len(fivePadField):])
+			if err == nil {
+				err = perr
+			}
+		case strings.HasPrefix(f, threePadField) && s.Pad != nil:
+			var perr error
+			s.ThreePad, perr = strconv.Atoi(f[len(threePadField):])
+			if err == nil {
+				err = perr
+			}
 		}
 	}
 	s.Offset = feat.OneToZero(start)
 	s.Desc = d
 	return err
 }
+
+// UCSCDescription returns the description of the sequence with the range
+// and strand fields regenerated from the location, offset, length and
+// strand of the sequence, converting the 0-based half-open coordinates used
+// by bíogo to the 1-based UCSC format. Other fields of the description are
+// retained. It is the inverse of SetDescription.
+func (s Seq) UCSCDescription() string {
+	var rng, strand string
+	if s.Loc != nil {
+		rng = fmt.Sprintf("%s%s:%d-%d", rangeField, s.Loc.Name(), feat.ZeroToOne(s.Offset), s.Offset+s.Len())
+	}
+	switch s.Strand {
+	case seq.Plus:
+		strand = strandField + "+"
+	case seq.Minus:
+		strand = strandField + "-"
+	}
+
+	var fields []string
+	for _, f := range strings.Fields(s.Desc) {
+		switch {
+		case strings.HasPrefix(f, rangeField):
+			f, rng = rng, ""
+		case strings.HasPrefix(f, strandField):
+			f, strand = strand, ""
+		}
+		if f != "" {
+			fields = append(fields, f)
+		}
+	}
+	for _, f := range []string{rng, strand} {
+		if f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,113 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ucsc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/io/seqio/fasta"
+	"github.com/biogo/biogo/seq"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+var fa = `>hg19_dna range=chr18:78016000-78016181 5'pad=0 3'pad=0 strand=+ repeatMasking=none
+AGAGGGAGGATTATTATAATATTGGAATAAAGAGTAATTGCTATCAACTA
+ATGATTAATGATATTCATATATAATCATGTCTAAGATCTATATCTGGTAT
+AACTATTCTTGTTTTATATTTTATTGGAGTGGAACAGCTCATGTCCTCGG
+TCTCTTGCCTCGGCAAAGATTAGATTAGGGTT
+>hg19_dna range=chr18:78015995-78016181 5'pad=5 3'pad=0 strand=+ repeatMasking=none
+ATTATAGAGGGAGGATTATTATAATATTGGAATAAAGAGTAATTGCTATC
+AACTAATGATTAATGATATTCATATATAATCATGTCTAAGATCTATATCT
+GGTATAACTATTCTTGTTTTATATTTTATTGGAGTGGAACAGCTCATGTC
+CTCGGTCTCTTGCCTCGGCAAAGATTAGATTAGGGTT
+>hg19_dna range=chr18:78016000-78016181 5'pad=0 3'pad=0 strand=- repeatMasking=none
+AACCCTAATCTAATCTTTGCCGAGGCAAGAGACCGAGGACATGAGCTGTT
+CCACTCCAATAAAATATAAAACAAGAATAGTTATACCAGATATAGATCTT
+AGACATGATTATATATGAATATCATTAATCATTAGTTGATAGCAATTACT
+CTTTATTCCAATATTATAATAATCCTCCCTCT
+>hg19_dna range=chr18:78016000-78016186 5'pad=5 3'pad=0 strand=- repeatMasking=none
+CACCTAACCCTAATCTAATCTTTGCCGAGGCAAGAGACCGAGGACATGAG
+CTGTTCCACTCCAATAAAATATAAAACAAGAATAGTTATACCAGATATAG
+ATCTTAGACATGATTATATATGAATATCATTAATCATTAGTTGATAGCAA
+TTACTCTTTATTCCAATATTATAATAATCCTCCCTCT
+`
+
+func readAll(c *check.C) []Seq {
+	var seqs []Seq
+	r := fasta.NewReader(strings.NewReader(fa), NewSeq("", nil, alphabet.DNA))
+	for {
+		s, err := r.Read()
+		if err != nil {
+			break
+		}
+		seqs = append(seqs, s.(Seq))
+	}
+	c.Assert(len(seqs), check.Equals, 4)
+	return seqs
+}
+
+func (s *S) TestRoundTrip(c *check.C) {
+	for i, sq := range readAll(c) {
+		desc := sq.Description()
+		c.Check(sq.UCSCDescription(), check.Equals, desc, check.Commentf("Test %d", i))
+
+		// Reparsing the formatted description must give
+		// the same annotation.
+		t := NewSeq(sq.Name(), sq.Seq.Seq, alphabet.DNA)
+		err := t.SetDescription(sq.UCSCDescription())
+		c.Check(err, check.Equals, nil)
+		c.Check(t.Loc, check.Equals, sq.Loc, check.Commentf("Test %d", i))
+		c.Check(t.Offset, check.Equals, sq.Offset, check.Commentf("Test %d", i))
+		c.Check(t.Strand, check.Equals, sq.Strand, check.Commentf("Test %d", i))
+	}
+}
+
+func (s *S) TestUCSCDescription(c *check.C) {
+	sq := readAll(c)[0]
+	sq.Offset = 99
+	sq.Strand = seq.Minus
+	c.Check(sq.UCSCDescription(), check.Equals,
+		"range=chr18:100-281 5'pad=0 3'pad=0 strand=- repeatMasking=none")
+
+	sq.Desc = ""
+	c.Check(sq.UCSCDescription(), check.Equals, "range=chr18:100-281 strand=-")
+}
+
+func (s *S) TestPad(c *check.C) {
+	for i, t := range []struct {
+		five, three  int
+		start, end   int
+		ustart, uend int
+	}{
+		{five: 0, three: 0, start: 78015999, end: 78016181, ustart: 78015999, uend: 78016181},
+		{five: 5, three: 0, start: 78015994, end: 78016181, ustart: 78015999, uend: 78016181},
+		{five: 0, three: 0, start: 78015999, end: 78016181, ustart: 78015999, uend: 78016181},
+		// The 5' padding of a minus strand sequence is at its end.
+		{five: 5, three: 0, start: 78015999, end: 78016186, ustart: 78015999, uend: 78016181},
+	} {
+		sq := readAll(c)[i]
+		c.Check(sq.FivePad, check.Equals, t.five, check.Commentf("Test %d", i))
+		c.Check(sq.ThreePad, check.Equals, t.three, check.Commentf("Test %d", i))
+		c.Check(sq.Start(), check.Equals, t.start, check.Commentf("Test %d", i))
+		c.Check(sq.End(), check.Equals, t.end, check.Commentf("Test %d", i))
+		start, end := sq.Unpadded()
+		c.Check(start, check.Equals, t.ustart, check.Commentf("Test %d", i))
+		c.Check(end, check.Equals, t.uend, check.Commentf("Test %d", i))
+
+		cl := sq.Clone().(Seq)
+		c.Check(*cl.Pad, check.Equals, *sq.Pad, check.Commentf("Test %d", i))
+		cl.FivePad++
+		c.Check(cl.FivePad, check.Not(check.Equals), sq.FivePad, check.Commentf("Test %d", i))
+	}
+}